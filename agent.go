@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// The coordinator drives the agents over HTTP, one phase per request:
+//
+//	POST /subscribe  agentJob with the settings and subscribers, returns once they are subscribed
+//	POST /publish    agentJob with the publishers, returns their agentPubResult when they are done
+//	POST /finish     stops the subscribers and returns their agentSubResult
+//	POST /interrupt  interrupts the run, as SIGINT does for a local run
+//	GET  /time       answers a clock ping with the agent time, see estimateClock
+//	POST /clock      ClockSync correcting the clock of the run in progress
+
+// agentJob is the part of a run given to an agent
+type agentJob struct {
+	Settings    RunSettings   `json:"settings"`
+	Clock       *ClockSync    `json:"clock,omitempty"`
+	Subscribers []*SubClient  `json:"subscribers,omitempty"`
+	Publishers  []*PubClient  `json:"publishers,omitempty"`
+	Echoes      []*EchoClient `json:"echoes,omitempty"`
+}
+
+// agentPubResult carries the results of a publisher with its histogram, which the report leaves out
+type agentPubResult struct {
+	Results *PubResults `json:"results"`
+	PubHist *Histogram  `json:"pub_hist"`
+	RTTHist *Histogram  `json:"rtt_hist,omitempty"`
+}
+
+// agentSubResult carries the results of a subscriber with its histograms, which the report leaves out
+type agentSubResult struct {
+	Results       *SubResults `json:"results"`
+	FwdHist       *Histogram  `json:"fwd_hist"`
+	SameNodeHist  *Histogram  `json:"same_node_hist"`
+	CrossNodeHist *Histogram  `json:"cross_node_hist"`
+}
+
+// agent runs the clients assigned by a coordinator, one run at a time
+type agent struct {
+	mu         sync.Mutex
+	run        *Run
+	subscribed chan bool // closed once the subscribers of run are subscribed
+	metrics    *Metrics
+}
+
+// runAgent implements the "agent" subcommand
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	var (
+		listen      = fs.String("listen", ":7070", "Address the coordinator connects to.")
+		metricsAddr = fs.String("metrics", "", "Serve live Prometheus metrics of the agent's clients on this address at /metrics.")
+		topicGroup  = fs.Int("topicgroup", 0, "Label the Prometheus metrics by groups of this many consecutive topics, 0 puts all topics in one group.")
+	)
+	fs.Parse(args)
+
+	a := &agent{metrics: NewMetrics()}
+	if *metricsAddr != "" {
+		a.metrics.prom = newPromRegistry(*topicGroup)
+		if err := a.metrics.prom.listen(*metricsAddr); err != nil {
+			log.Fatalf("Error serving metrics on %v: %v\n", *metricsAddr, err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subscribe", a.subscribe)
+	mux.HandleFunc("/publish", a.publish)
+	mux.HandleFunc("/finish", a.finish)
+	mux.HandleFunc("/interrupt", a.interrupt)
+	mux.HandleFunc("/time", serveTime)
+	mux.HandleFunc("/clock", a.clock)
+	log.Printf("Agent listening on %v\n", *listen)
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
+
+// current returns the run in progress, or fails the request
+func (a *agent) current(w http.ResponseWriter) *Run {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.run == nil {
+		http.Error(w, "no run in progress", http.StatusConflict)
+	}
+	return a.run
+}
+
+func (a *agent) subscribe(w http.ResponseWriter, r *http.Request) {
+	var job agentJob
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	unit, ok := latencyUnits[job.Settings.Unit]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown latency unit %q", job.Settings.Unit), http.StatusBadRequest)
+		return
+	}
+	// the TLS files are read here: a client failing to load them would never report back
+	var settings []*TLSSettings
+	for _, c := range job.Subscribers {
+		settings = append(settings, c.TLS)
+	}
+	for _, c := range job.Echoes {
+		settings = append(settings, c.TLS)
+	}
+	if err := checkTLS(settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	if stale := a.run; stale != nil {
+		// the coordinator of the previous run failed or was killed before /finish: stop its clients
+		log.Printf("Replacing the run left unfinished by a previous coordinator\n")
+		if !closed(stale.Interrupt) {
+			close(stale.Interrupt)
+		}
+		go func(subscribed chan bool) {
+			<-subscribed
+			stale.Finish()
+		}(a.subscribed)
+	}
+	latencyUnit = unit
+	run := &Run{
+		Settings:    job.Settings,
+		Subscribers: job.Subscribers,
+		Echoes:      job.Echoes,
+		Metrics:     a.metrics,
+		Window:      new(Window),
+		Clock:       new(Clock),
+		Interrupt:   make(chan bool),
+	}
+	if job.Clock != nil {
+		run.Clock.set(*job.Clock)
+	}
+	subscribed := make(chan bool)
+	a.run, a.subscribed = run, subscribed
+	a.mu.Unlock()
+
+	log.Printf("Running %v subscribers and %v echo responders\n", len(run.Subscribers), len(run.Echoes))
+	run.Subscribe()
+	close(subscribed)
+	writeAgentResponse(w, struct{}{})
+}
+
+func (a *agent) publish(w http.ResponseWriter, r *http.Request) {
+	run := a.current(w)
+	if run == nil {
+		return
+	}
+	var job agentJob
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, c := range job.Publishers {
+		if err := decodeTrace(c.Trace); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.prepare(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkTLS([]*TLSSettings{c.TLS}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("Running %v publishers\n", len(job.Publishers))
+	run.Publishers = job.Publishers
+	results := make([]agentPubResult, 0, len(run.Publishers))
+	for _, res := range run.Publish() {
+		results = append(results, agentPubResult{Results: res, PubHist: res.PubHist, RTTHist: res.RTTHist})
+	}
+	writeAgentResponse(w, results)
+}
+
+func (a *agent) finish(w http.ResponseWriter, r *http.Request) {
+	// the run is taken at once, so that a new /subscribe does not stop it a second time
+	a.mu.Lock()
+	run, subscribed := a.run, a.subscribed
+	a.run = nil
+	a.mu.Unlock()
+	if run == nil {
+		http.Error(w, "no run in progress", http.StatusConflict)
+		return
+	}
+	<-subscribed
+	results := make([]agentSubResult, 0, len(run.Subscribers))
+	for _, res := range run.Finish() {
+		results = append(results, agentSubResult{
+			Results:       res,
+			FwdHist:       res.FwdHist,
+			SameNodeHist:  res.SameNodeHist,
+			CrossNodeHist: res.CrossNodeHist,
+		})
+	}
+	log.Printf("Run done\n")
+	writeAgentResponse(w, results)
+}
+
+func (a *agent) clock(w http.ResponseWriter, r *http.Request) {
+	run := a.current(w)
+	if run == nil {
+		return
+	}
+	var s ClockSync
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	run.Clock.set(s)
+	writeAgentResponse(w, struct{}{})
+}
+
+func (a *agent) interrupt(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	if a.run != nil && !closed(a.run.Interrupt) {
+		log.Printf("Run interrupted by the coordinator\n")
+		close(a.run.Interrupt)
+	}
+	a.mu.Unlock()
+	writeAgentResponse(w, struct{}{})
+}
+
+// writeAgentResponse writes v as JSON; undefined statistics are sent as 0, as in the JSON report
+func writeAgentResponse(w http.ResponseWriter, v interface{}) {
+	finiteFloats(reflect.ValueOf(v))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing the response to the coordinator: %v\n", err)
+	}
+}
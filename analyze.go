@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// NodeEstimate describes the traffic predicted for a single broker node
+type NodeEstimate struct {
+	NodeID       int     `json:"node_id"`
+	Publishers   int     `json:"publishers"`
+	Subscribers  int     `json:"subscribers"`
+	ExtIn        float64 `json:"aei"`
+	ExtOut       float64 `json:"aeo"`
+	IntIn        float64 `json:"internal_in"`
+	IntOut       float64 `json:"internal_out"`
+	ActiveTopics []int   `json:"active_topics"`
+	FairnessIn   float64 `json:"fairness_in"`
+	FairnessOut  float64 `json:"fairness_out"`
+}
+
+// PlacementEstimate describes the traffic predicted for a whole placement
+type PlacementEstimate struct {
+	File           string          `json:"file"`
+	Nodes          []*NodeEstimate `json:"nodes"`
+	TotalExtIn     float64         `json:"total_aei"`
+	TotalExtOut    float64         `json:"total_aeo"`
+	TotalInternal  float64         `json:"total_internal"`
+	MaxFairnessIn  float64         `json:"max_fairness_in"`
+	MaxFairnessOut float64         `json:"max_fairness_out"`
+}
+
+// usersState builds the per-node topic counters of a placement with M nodes
+func usersState(user Users, nodes int, rates []float64) (*clusterState, error) {
+	state := newClusterState(nodes, rates)
+	for _, pub := range user.Publishers {
+		if pub.NodeID < 1 || pub.NodeID > nodes {
+			return nil, fmt.Errorf("publisher %v has node_id %v out of [1, %v]", pub.PubID, pub.NodeID, nodes)
+		}
+		for _, t := range pub.TopicList {
+			state.add(state.np, t, pub.NodeID)
+		}
+	}
+	for _, sub := range user.Subscribers {
+		if sub.NodeID < 1 || sub.NodeID > nodes {
+			return nil, fmt.Errorf("subscriber %v has node_id %v out of [1, %v]", sub.SubID, sub.NodeID, nodes)
+		}
+		for _, t := range sub.TopicList {
+			state.add(state.ns, t, sub.NodeID)
+		}
+	}
+	return state, nil
+}
+
+// estimatePlacement predicts the external and internal traffic of every node. A publication of
+// topic t entering node h is forwarded once to every other node having a subscriber of t (Eq. 3),
+// which is the traffic a subscriber of a topic not active on its node attracts (Eq. 1).
+func estimatePlacement(user Users, nodes int, rates []float64) (*PlacementEstimate, error) {
+	state, err := usersState(user, nodes, rates)
+	if err != nil {
+		return nil, err
+	}
+
+	est := new(PlacementEstimate)
+	for k := 1; k <= nodes; k++ {
+		est.Nodes = append(est.Nodes, &NodeEstimate{NodeID: k, ActiveTopics: []int{}})
+	}
+	for _, pub := range user.Publishers {
+		est.Nodes[pub.NodeID-1].Publishers++
+	}
+	for _, sub := range user.Subscribers {
+		est.Nodes[sub.NodeID-1].Subscribers++
+	}
+
+	aei := state.externalIn()
+	aeo := state.externalOut()
+	for k, node := range est.Nodes {
+		node.ExtIn = aei[k]
+		node.ExtOut = aeo[k]
+		est.TotalExtIn += aei[k]
+		est.TotalExtOut += aeo[k]
+	}
+
+	for t, pubs := range state.np {
+		subs := state.ns[t]
+		if subs == nil {
+			continue
+		}
+		for h, n := range pubs {
+			if n == 0 {
+				continue
+			}
+			for k := range subs {
+				if k != h && subs[k] > 0 {
+					rate := state.rate(t) * float64(n)
+					est.Nodes[h].IntOut += rate
+					est.Nodes[k].IntIn += rate
+					est.TotalInternal += rate
+				}
+			}
+		}
+	}
+
+	for k, node := range est.Nodes {
+		for t := 1; t < len(rates); t++ {
+			if state.active(t, k+1) {
+				node.ActiveTopics = append(node.ActiveTopics, t)
+			}
+		}
+
+		if est.TotalExtIn > 0 {
+			node.FairnessIn = node.ExtIn / (est.TotalExtIn / float64(nodes))
+		}
+		if est.TotalExtOut > 0 {
+			node.FairnessOut = node.ExtOut / (est.TotalExtOut / float64(nodes))
+		}
+		if node.FairnessIn > est.MaxFairnessIn {
+			est.MaxFairnessIn = node.FairnessIn
+		}
+		if node.FairnessOut > est.MaxFairnessOut {
+			est.MaxFairnessOut = node.FairnessOut
+		}
+	}
+
+	return est, nil
+}
+
+func printEstimate(est *PlacementEstimate) {
+	fmt.Printf("================= PLACEMENT ESTIMATE (%d nodes) =================\n", len(est.Nodes))
+	fmt.Printf("%-6s %6s %6s %12s %12s %12s %12s %8s %8s %8s\n", "node", "pubs", "subs", "Aei", "Aeo", "int in", "int out", "|Ta|", "Aei/fair", "Aeo/fair")
+	for _, n := range est.Nodes {
+		fmt.Printf("%-6d %6d %6d %12.2f %12.2f %12.2f %12.2f %8d %8.2f %8.2f\n", n.NodeID, n.Publishers, n.Subscribers, n.ExtIn, n.ExtOut, n.IntIn, n.IntOut, len(n.ActiveTopics), n.FairnessIn, n.FairnessOut)
+	}
+	fmt.Printf("\nTotal external in (msg/sec):    %.2f\n", est.TotalExtIn)
+	fmt.Printf("Total external out (msg/sec):   %.2f\n", est.TotalExtOut)
+	fmt.Printf("Total internal (msg/sec):       %.2f\n", est.TotalInternal)
+	fmt.Printf("Max fairness in / out:          %.2f / %.2f\n", est.MaxFairnessIn, est.MaxFairnessOut)
+}
+
+// runAnalyze implements the "analyze" subcommand
+func runAnalyze(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	var (
+		file      = fs.String("file", "test.json", "Clients file to analyze.")
+		nodes     = fs.Int("nodes", 0, "Number of broker nodes M (default the highest node_id in the file).")
+		rate      = fs.Float64("rate", 1.0, "Publication rate of every topic (msg/sec).")
+		ratesFile = fs.String("rates", "", "JSON file mapping topics to their publication rate (msg/sec).")
+		out       = fs.String("json", "", "Write the estimate as JSON to this file (\"-\" for stdout).")
+	)
+	fs.Parse(args)
+
+	data, err := ioutil.ReadFile(*file)
+	if err != nil {
+		log.Fatalf("analyze: %v\n", err)
+	}
+	var user Users
+	if err := json.Unmarshal(data, &user); err != nil {
+		log.Fatalf("analyze: parsing %v: %v\n", *file, err)
+	}
+
+	m, topics := *nodes, 0
+	for _, pub := range user.Publishers {
+		if *nodes == 0 && pub.NodeID > m {
+			m = pub.NodeID
+		}
+		for _, t := range pub.TopicList {
+			if t > topics {
+				topics = t
+			}
+		}
+	}
+	for _, sub := range user.Subscribers {
+		if *nodes == 0 && sub.NodeID > m {
+			m = sub.NodeID
+		}
+		for _, t := range sub.TopicList {
+			if t > topics {
+				topics = t
+			}
+		}
+	}
+
+	p := PlacementParams{Topics: topics, Rate: *rate}
+	if *ratesFile != "" {
+		if p.Rates, err = loadTopicRates(*ratesFile, topics, *rate); err != nil {
+			log.Fatalf("analyze: %v\n", err)
+		}
+	}
+
+	est, err := estimatePlacement(user, m, p.topicRates())
+	if err != nil {
+		log.Fatalf("analyze: %v\n", err)
+	}
+	est.File = *file
+
+	if *out != "-" {
+		printEstimate(est)
+	}
+	if *out != "" {
+		w := os.Stdout
+		if *out != "-" {
+			f, err := os.Create(*out)
+			if err != nil {
+				log.Fatalf("analyze: %v\n", err)
+			}
+			defer f.Close()
+			w = f
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(est); err != nil {
+			log.Fatalf("analyze: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/rand"
+	"gonum.org/v1/gonum/stat/distuv"
+)
+
+// ArrivalProcess draws the times between consecutive publications
+type ArrivalProcess interface {
+	// Next returns the time until the next publication, elapsed being the time since the start of the run
+	Next(elapsed time.Duration) time.Duration
+}
+
+// ArrivalSpec selects an arrival process and its parameters
+type ArrivalSpec struct {
+	Name   string
+	Params map[string]float64
+}
+
+// arrivalDefaults lists the parameters accepted by every model with their default value
+var arrivalDefaults = map[string]map[string]float64{
+	"constant":  {},
+	"poisson":   {},
+	"lognormal": {"cv": 4},
+	"pareto":    {"alpha": 2.5},
+	"weibull":   {"k": 1.5},
+	"mmpp":      {"on": 1, "off": 1, "offrate": 0},
+	"diurnal":   {"period": 86400, "amplitude": 0.5},
+}
+
+// parseArrivalSpec builds a spec from a model name and a "key=value,key=value" parameter list
+func parseArrivalSpec(name string, params string) (ArrivalSpec, error) {
+	spec := ArrivalSpec{Name: strings.ToLower(name), Params: make(map[string]float64)}
+	defaults, ok := arrivalDefaults[spec.Name]
+	if !ok {
+		return spec, fmt.Errorf("unknown distribution %q", name)
+	}
+	for k, v := range defaults {
+		spec.Params[k] = v
+	}
+	for _, kv := range strings.Split(params, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if _, ok := defaults[key]; !ok || len(parts) != 2 {
+			return spec, fmt.Errorf("invalid parameter %q for distribution %v", kv, spec.Name)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return spec, fmt.Errorf("invalid value for parameter %v: %v", key, err)
+		}
+		spec.Params[key] = v
+	}
+	return spec, nil
+}
+
+// String describes the model and its parameters, e.g. "lognormal (cv=4)"
+func (spec ArrivalSpec) String() string {
+	keys := make([]string, 0, len(spec.Params))
+	for k := range spec.Params {
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return spec.Name
+	}
+	sort.Strings(keys)
+	params := make([]string, len(keys))
+	for i, k := range keys {
+		params[i] = fmt.Sprintf("%v=%v", k, spec.Params[k])
+	}
+	return fmt.Sprintf("%v (%v)", spec.Name, strings.Join(params, ", "))
+}
+
+// New returns a process of the spec with mean rate lambda (msg/sec)
+func (spec ArrivalSpec) New(lambda float64, r *rand.Rand) (ArrivalProcess, error) {
+	if lambda <= 0 {
+		return nil, fmt.Errorf("rate must be positive, got %v", lambda)
+	}
+	mean := 1 / lambda
+	p := spec.Params
+	switch spec.Name {
+	case "constant":
+		return constantArrival{period: mean}, nil
+	case "poisson":
+		return poissonArrival{lambda: lambda, r: r}, nil
+	case "lognormal":
+		if p["cv"] <= 0 {
+			return nil, fmt.Errorf("lognormal cv must be positive")
+		}
+		v := math.Pow(p["cv"]*mean, 2)
+		mu := math.Log(math.Pow(mean, 2) / math.Sqrt(v+math.Pow(mean, 2)))
+		sigma := math.Sqrt(math.Log((v / math.Pow(mean, 2)) + 1))
+		return distArrival{distuv.LogNormal{Mu: mu, Sigma: sigma, Src: r}}, nil
+	case "pareto":
+		if p["alpha"] <= 1 {
+			return nil, fmt.Errorf("pareto alpha must be greater than 1 for a finite mean")
+		}
+		return distArrival{distuv.Pareto{Xm: mean * (p["alpha"] - 1) / p["alpha"], Alpha: p["alpha"], Src: r}}, nil
+	case "weibull":
+		if p["k"] <= 0 {
+			return nil, fmt.Errorf("weibull k must be positive")
+		}
+		return distArrival{distuv.Weibull{K: p["k"], Lambda: mean / math.Gamma(1+1/p["k"]), Src: r}}, nil
+	case "mmpp":
+		if p["on"] <= 0 || p["off"] <= 0 || p["offrate"] < 0 {
+			return nil, fmt.Errorf("mmpp on and off must be positive and offrate not negative")
+		}
+		// the on rate is chosen so that the long-run mean rate is lambda
+		onRate := (lambda*(p["on"]+p["off"]) - p["offrate"]*p["off"]) / p["on"]
+		if onRate <= 0 {
+			return nil, fmt.Errorf("mmpp offrate is too high for a mean rate of %v", lambda)
+		}
+		return &mmppArrival{rates: [2]float64{onRate, p["offrate"]}, sojourn: [2]float64{p["on"], p["off"]}, r: r}, nil
+	case "diurnal":
+		if p["period"] <= 0 || p["amplitude"] < 0 || p["amplitude"] > 1 {
+			return nil, fmt.Errorf("diurnal period must be positive and amplitude in [0, 1]")
+		}
+		return diurnalArrival{lambda: lambda, period: p["period"], amplitude: p["amplitude"], r: r}, nil
+	}
+	return nil, fmt.Errorf("unknown distribution %q", spec.Name)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// constantArrival publishes at a fixed period
+type constantArrival struct {
+	period float64
+}
+
+func (a constantArrival) Next(elapsed time.Duration) time.Duration {
+	return seconds(a.period)
+}
+
+// poissonArrival has exponential inter-arrival times
+type poissonArrival struct {
+	lambda float64
+	r      *rand.Rand
+}
+
+func (a poissonArrival) Next(elapsed time.Duration) time.Duration {
+	return seconds(a.r.ExpFloat64() / a.lambda)
+}
+
+// distArrival draws inter-arrival times from a renewal distribution
+type distArrival struct {
+	dist distuv.Rander
+}
+
+func (a distArrival) Next(elapsed time.Duration) time.Duration {
+	return seconds(a.dist.Rand())
+}
+
+// mmppArrival is a two-state Markov-modulated Poisson process alternating
+// exponentially distributed on (burst) and off periods
+type mmppArrival struct {
+	rates   [2]float64
+	sojourn [2]float64
+	state   int
+	left    float64
+	r       *rand.Rand
+}
+
+func (a *mmppArrival) Next(elapsed time.Duration) time.Duration {
+	wait := 0.0
+	if a.left == 0 {
+		a.left = a.r.ExpFloat64() * a.sojourn[a.state]
+	}
+	for {
+		next := math.Inf(1)
+		if a.rates[a.state] > 0 {
+			next = a.r.ExpFloat64() / a.rates[a.state]
+		}
+		if next < a.left {
+			a.left -= next
+			return seconds(wait + next)
+		}
+		// no arrival before the state switch, the process is memoryless
+		wait += a.left
+		a.state = 1 - a.state
+		a.left = a.r.ExpFloat64() * a.sojourn[a.state]
+	}
+}
+
+// diurnalArrival is a Poisson process whose rate follows a sinusoid
+// lambda*(1 + amplitude*sin(2*pi*t/period)), sampled by thinning
+type diurnalArrival struct {
+	lambda    float64
+	period    float64
+	amplitude float64
+	r         *rand.Rand
+}
+
+func (a diurnalArrival) Next(elapsed time.Duration) time.Duration {
+	max := a.lambda * (1 + a.amplitude)
+	t := elapsed.Seconds()
+	start := t
+	for {
+		t += a.r.ExpFloat64() / max
+		rate := a.lambda * (1 + a.amplitude*math.Sin(2*math.Pi*t/a.period))
+		if a.r.Float64()*max <= rate {
+			return seconds(t - start)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clockSamples is the number of ping-pongs of an offset estimation: as in NTP, the one with the
+// smallest round trip, the least delayed by the network and the scheduler, gives the estimate
+const clockSamples = 16
+
+// clockInterval is the period of the offset estimations while the publishers run
+const clockInterval = 10 * time.Second
+
+// ClockEstimate is the offset of the clock of an agent to the clock of the coordinator
+type ClockEstimate struct {
+	Offset      int64 // agent minus coordinator, ns
+	Uncertainty int64 // half the smallest round trip, ns
+	At          int64 // coordinator time of the estimate, Unix ns
+}
+
+// agentTime is the reply of an agent to a clock ping, in agent time
+type agentTime struct {
+	Received int64 `json:"received"`
+	Sent     int64 `json:"sent"`
+}
+
+// ClockSync is the correction of the clock of an agent sent by the coordinator
+type ClockSync struct {
+	Offset      int64   `json:"offset"`      // agent minus coordinator at At, ns
+	At          int64   `json:"at"`          // agent time of the offset, Unix ns
+	Drift       float64 `json:"drift"`       // change of the offset per ns
+	Uncertainty int64   `json:"uncertainty"` // of the latencies between any two agents, ns
+}
+
+// Clock converts the local time of an agent to the time of the coordinator, which all the agents
+// of a run share, so that latencies between agents can be measured. A nil Clock is the
+// coordinator clock, as for a run in a single process.
+type Clock struct {
+	mu   sync.RWMutex
+	sync ClockSync
+}
+
+// set replaces the correction of the clock
+func (c *Clock) set(s ClockSync) {
+	c.mu.Lock()
+	c.sync = s
+	c.mu.Unlock()
+}
+
+// offset returns the offset of the clock at local time t
+func (c *Clock) offset(t int64) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sync.Offset + int64(c.sync.Drift*float64(t-c.sync.At))
+}
+
+// reference converts a local time (Unix nanoseconds) to coordinator time
+func (c *Clock) reference(t int64) int64 {
+	if c == nil {
+		return t
+	}
+	return t - c.offset(t)
+}
+
+// local converts a coordinator time (Unix nanoseconds) to local time
+func (c *Clock) local(t int64) int64 {
+	if c == nil {
+		return t
+	}
+	return t + c.offset(t)
+}
+
+// uncertainty returns the uncertainty of the latencies measured with the clock
+func (c *Clock) uncertainty() time.Duration {
+	if c == nil {
+		return 0
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return time.Duration(c.sync.Uncertainty)
+}
+
+// serveTime answers a clock ping of the coordinator
+func serveTime(w http.ResponseWriter, r *http.Request) {
+	received := time.Now().UnixNano()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agentTime{Received: received, Sent: time.Now().UnixNano()})
+}
+
+// estimateClock estimates the offset of the clock of the agent at addr with NTP-style ping-pongs
+func estimateClock(addr string) (ClockEstimate, error) {
+	var best ClockEstimate
+	bestRTT := int64(-1)
+	for i := 0; i < clockSamples; i++ {
+		sent := time.Now().UnixNano()
+		resp, err := http.Get(addr + "/time")
+		if err != nil {
+			return best, err
+		}
+		var t agentTime
+		err = json.NewDecoder(resp.Body).Decode(&t)
+		resp.Body.Close()
+		received := time.Now().UnixNano()
+		if resp.StatusCode != http.StatusOK {
+			return best, fmt.Errorf("%v", resp.Status)
+		}
+		if err != nil {
+			return best, err
+		}
+
+		rtt := (received - sent) - (t.Sent - t.Received)
+		if bestRTT < 0 || rtt < bestRTT {
+			bestRTT = rtt
+			best = ClockEstimate{
+				Offset:      ((t.Received - sent) + (t.Sent - received)) / 2,
+				Uncertainty: rtt / 2,
+				At:          received,
+			}
+		}
+	}
+	return best, nil
+}
+
+// ClockResults describes the clock of an agent during a run. Only the estimates taken before the
+// subscribers stop correct the latencies: the one after the run checks the drift, it corrects nothing.
+type ClockResults struct {
+	Agent        string  `json:"agent"`
+	Estimates    int     `json:"estimates"`
+	Applied      int     `json:"applied_estimates"`
+	OffsetBefore float64 `json:"offset_before"`
+	OffsetAfter  float64 `json:"offset_after"`
+	Drift        float64 `json:"drift_ppm"`
+	Uncertainty  float64 `json:"uncertainty"`
+}
+
+// clockUncertainty returns the uncertainty of the latencies between two agents: the sum of the
+// two largest uncertainties, 0 with a single agent as its clients share its clock
+func clockUncertainty(uncertainties []int64) int64 {
+	if len(uncertainties) < 2 {
+		return 0
+	}
+	sorted := append([]int64(nil), uncertainties...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+	return sorted[0] + sorted[1]
+}
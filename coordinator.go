@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Coordinator runs the clients of a benchmark on remote agents, in lock-step: every phase
+// starts on all the agents once the previous one is over on all of them.
+// A phase that fails on an agent aborts the run on all the others, which then report partial
+// results as after an interruption.
+// The clocks of the agents are corrected to the clock of the coordinator, estimated before the
+// subscriptions, periodically while the publishers run and after the results are collected.
+type Coordinator struct {
+	Settings  RunSettings
+	Agents    []string
+	Interrupt chan bool
+
+	subs   [][]*SubClient
+	pubs   [][]*PubClient
+	echoes [][]*EchoClient
+
+	mu          sync.Mutex
+	estimates   [][]ClockEstimate
+	uncertainty int64    // largest uncertainty sent to the agents, ns
+	applied     []int    // estimates of every agent sent to it before the run finished
+	failed      []string // agents that failed a phase
+	aborted     chan bool
+	abortOnce   sync.Once
+}
+
+// newCoordinator splits the clients between the agents, either round robin ("client") or
+// with all the clients of a broker node on the same agent ("node")
+func newCoordinator(agents []string, split string, settings RunSettings, subs []*SubClient, pubs []*PubClient, echoes []*EchoClient, interrupt chan bool) (*Coordinator, error) {
+	c := &Coordinator{Settings: settings, Interrupt: interrupt, aborted: make(chan bool)}
+	for _, addr := range agents {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		c.Agents = append(c.Agents, strings.TrimSuffix(addr, "/"))
+	}
+	if len(c.Agents) == 0 {
+		return nil, fmt.Errorf("no agent")
+	}
+
+	var agentOf func(node int, i int) int
+	switch split {
+	case "client":
+		agentOf = func(node int, i int) int { return i % len(c.Agents) }
+	case "node":
+		var nodes []int
+		seen := make(map[int]bool)
+		for _, sub := range subs {
+			if !seen[sub.NodeID] {
+				seen[sub.NodeID] = true
+				nodes = append(nodes, sub.NodeID)
+			}
+		}
+		for _, pub := range pubs {
+			if !seen[pub.NodeID] {
+				seen[pub.NodeID] = true
+				nodes = append(nodes, pub.NodeID)
+			}
+		}
+		for _, echo := range echoes {
+			if !seen[echo.NodeID] {
+				seen[echo.NodeID] = true
+				nodes = append(nodes, echo.NodeID)
+			}
+		}
+		sort.Ints(nodes)
+		position := make(map[int]int)
+		for i, node := range nodes {
+			position[node] = i
+		}
+		agentOf = func(node int, i int) int { return position[node] % len(c.Agents) }
+	default:
+		return nil, fmt.Errorf("unknown split %q", split)
+	}
+
+	c.subs = make([][]*SubClient, len(c.Agents))
+	c.pubs = make([][]*PubClient, len(c.Agents))
+	c.echoes = make([][]*EchoClient, len(c.Agents))
+	c.estimates = make([][]ClockEstimate, len(c.Agents))
+	for i, sub := range subs {
+		k := agentOf(sub.NodeID, i)
+		c.subs[k] = append(c.subs[k], sub)
+	}
+	for i, pub := range pubs {
+		k := agentOf(pub.NodeID, i)
+		c.pubs[k] = append(c.pubs[k], pub)
+	}
+	for i, echo := range echoes {
+		k := agentOf(echo.NodeID, i)
+		c.echoes[k] = append(c.echoes[k], echo)
+	}
+
+	// forward an interruption or an abort to the agents
+	go func() {
+		select {
+		case <-interrupt:
+		case <-c.aborted:
+		}
+		c.all(func(k int) error { return c.post(k, "/interrupt", nil, nil) })
+	}()
+	return c, nil
+}
+
+func (c *Coordinator) Subscribe() {
+	if !c.Settings.Quiet {
+		log.Printf("Starting to subscribe on %v agents...\n", len(c.Agents))
+	}
+	c.estimateClocks()
+	c.phase(func(k int) error {
+		return c.post(k, "/subscribe", agentJob{Settings: c.Settings, Clock: c.clockSync(k), Subscribers: c.subs[k], Echoes: c.echoes[k]}, nil)
+	})
+	if !c.Settings.Quiet {
+		log.Printf("All subscribtion jobs are done.\n")
+	}
+}
+
+func (c *Coordinator) Publish() []*PubResults {
+	if closed(c.aborted) {
+		return nil
+	}
+	if !c.Settings.Quiet {
+		log.Printf("Starting publish on %v agents...\n", len(c.Agents))
+	}
+	// follow the drift of the clocks during the publication
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(clockInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.estimateClocks()
+				c.all(func(k int) error { return c.post(k, "/clock", c.clockSync(k), nil) })
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	results := make([][]agentPubResult, len(c.Agents))
+	c.phase(func(k int) error {
+		return c.post(k, "/publish", agentJob{Settings: c.Settings, Publishers: c.pubs[k]}, &results[k])
+	})
+	close(stop)
+
+	var pubresults []*PubResults
+	for _, agentResults := range results {
+		for _, res := range agentResults {
+			res.Results.PubHist = res.PubHist
+			res.Results.RTTHist = res.RTTHist
+			pubresults = append(pubresults, res.Results)
+		}
+	}
+	return pubresults
+}
+
+func (c *Coordinator) Finish() []*SubResults {
+	results := make([][]agentSubResult, len(c.Agents))
+	c.phase(func(k int) error { return c.post(k, "/finish", nil, &results[k]) })
+	c.mu.Lock()
+	c.applied = make([]int, len(c.Agents))
+	for k, estimates := range c.estimates {
+		c.applied[k] = len(estimates)
+	}
+	c.mu.Unlock()
+	// the last estimate only shows how far the clocks drifted from the corrections applied
+	c.estimateClocks()
+
+	var subresults []*SubResults
+	for _, agentResults := range results {
+		for _, res := range agentResults {
+			res.Results.FwdHist = res.FwdHist
+			res.Results.SameNodeHist = res.SameNodeHist
+			res.Results.CrossNodeHist = res.CrossNodeHist
+			subresults = append(subresults, res.Results)
+		}
+	}
+	return subresults
+}
+
+// estimateClocks estimates the clock offset of every agent
+func (c *Coordinator) estimateClocks() {
+	c.all(func(k int) error {
+		est, err := estimateClock(c.Agents[k])
+		if err != nil {
+			return fmt.Errorf("clock estimation: %v", err)
+		}
+		c.mu.Lock()
+		c.estimates[k] = append(c.estimates[k], est)
+		c.mu.Unlock()
+		return nil
+	})
+}
+
+// clockSync returns the correction of the clock of agent k from its last estimate, with the drift
+// since its first one. The uncertainty is that of the latencies between any two agents.
+func (c *Coordinator) clockSync(k int) *ClockSync {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var uncertainties []int64
+	for _, estimates := range c.estimates {
+		if n := len(estimates); n > 0 {
+			uncertainties = append(uncertainties, estimates[n-1].Uncertainty)
+		}
+	}
+	s := &ClockSync{Uncertainty: clockUncertainty(uncertainties)}
+	if s.Uncertainty > c.uncertainty {
+		c.uncertainty = s.Uncertainty
+	}
+	estimates := c.estimates[k]
+	if len(estimates) == 0 {
+		return s
+	}
+	first, last := estimates[0], estimates[len(estimates)-1]
+	s.Offset = last.Offset
+	s.At = last.At + last.Offset
+	if last.At > first.At {
+		s.Drift = float64(last.Offset-first.Offset) / float64(last.At-first.At)
+	}
+	return s
+}
+
+// clockResults describes the clocks of the agents, from their first and last estimates
+func (c *Coordinator) clockResults() []*ClockResults {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	results := make([]*ClockResults, len(c.Agents))
+	for k, estimates := range c.estimates {
+		res := &ClockResults{Agent: c.Agents[k], Estimates: len(estimates)}
+		if c.applied != nil {
+			res.Applied = c.applied[k]
+		}
+		if n := len(estimates); n > 0 {
+			first, last := estimates[0], estimates[n-1]
+			res.OffsetBefore = inUnit(time.Duration(first.Offset))
+			res.OffsetAfter = inUnit(time.Duration(last.Offset))
+			if last.At > first.At {
+				res.Drift = float64(last.Offset-first.Offset) / float64(last.At-first.At) * 1e6
+			}
+			var uncertainty int64
+			for _, est := range estimates {
+				if est.Uncertainty > uncertainty {
+					uncertainty = est.Uncertainty
+				}
+			}
+			res.Uncertainty = inUnit(time.Duration(uncertainty))
+		}
+		results[k] = res
+	}
+	return results
+}
+
+// all runs f for every agent concurrently and waits for all of them. An agent that fails is
+// logged and its clients are missing from the results; all returns the agents that failed.
+func (c *Coordinator) all(f func(k int) error) []int {
+	var mu sync.Mutex
+	var failed []int
+	var wg sync.WaitGroup
+	for k := range c.Agents {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			if err := f(k); err != nil {
+				log.Printf("Agent %v: %v\n", c.Agents[k], err)
+				mu.Lock()
+				failed = append(failed, k)
+				mu.Unlock()
+			}
+		}(k)
+	}
+	wg.Wait()
+	return failed
+}
+
+// phase runs a phase of the run on every agent with all and aborts the run if any agent fails
+func (c *Coordinator) phase(f func(k int) error) {
+	failed := c.all(f)
+	if len(failed) == 0 {
+		return
+	}
+	c.mu.Lock()
+	for _, k := range failed {
+		c.failed = append(c.failed, c.Agents[k])
+	}
+	c.mu.Unlock()
+	c.abortOnce.Do(func() {
+		log.Printf("Aborting the run on all the agents.\n")
+		close(c.aborted)
+	})
+}
+
+// failedAgents returns the agents that failed a phase, sorted, once each
+func (c *Coordinator) failedAgents() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := make(map[string]bool)
+	var agents []string
+	for _, agent := range c.failed {
+		if !seen[agent] {
+			seen[agent] = true
+			agents = append(agents, agent)
+		}
+	}
+	sort.Strings(agents)
+	return agents
+}
+
+// post sends a request to an agent and decodes its JSON response into out, if not nil
+func (c *Coordinator) post(k int, path string, in interface{}, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(c.Agents[k]+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubAgent answers the coordinator like an agent, with one result per client it was given
+type stubAgent struct {
+	mu     sync.Mutex
+	calls  []string
+	subs   []*SubClient
+	pubs   []*PubClient
+	failOn string // phase answered with an error
+}
+
+func (a *stubAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/time" {
+		serveTime(w, r)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, r.URL.Path)
+	if r.URL.Path == a.failOn {
+		http.Error(w, "broken", http.StatusInternalServerError)
+		return
+	}
+	var job agentJob
+	switch r.URL.Path {
+	case "/subscribe":
+		json.NewDecoder(r.Body).Decode(&job)
+		a.subs = job.Subscribers
+		writeAgentResponse(w, struct{}{})
+	case "/publish":
+		json.NewDecoder(r.Body).Decode(&job)
+		a.pubs = job.Publishers
+		results := []agentPubResult{}
+		for _, c := range job.Publishers {
+			pubHist, rttHist := NewHistogram(), NewHistogram()
+			pubHist.Record(time.Millisecond)
+			rttHist.Record(2 * time.Millisecond)
+			results = append(results, agentPubResult{
+				Results: &PubResults{ID: c.ID, NodeID: c.NodeID, Successes: 1},
+				PubHist: pubHist,
+				RTTHist: rttHist,
+			})
+		}
+		writeAgentResponse(w, results)
+	case "/finish":
+		results := []agentSubResult{}
+		for _, c := range a.subs {
+			fwd, same, cross := NewHistogram(), NewHistogram(), NewHistogram()
+			fwd.Record(3 * time.Millisecond)
+			same.Record(3 * time.Millisecond)
+			results = append(results, agentSubResult{
+				Results:       &SubResults{ID: c.ID, NodeID: c.NodeID, Received: 1},
+				FwdHist:       fwd,
+				SameNodeHist:  same,
+				CrossNodeHist: cross,
+			})
+		}
+		writeAgentResponse(w, results)
+	default:
+		writeAgentResponse(w, struct{}{})
+	}
+}
+
+// phases returns the phases requested from the agent, in order
+func (a *stubAgent) phases() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.calls...)
+}
+
+func testClients() ([]*SubClient, []*PubClient) {
+	subs := []*SubClient{{ID: "1.1", NodeID: 1}, {ID: "2.1", NodeID: 2}, {ID: "3.1", NodeID: 1}}
+	pubs := []*PubClient{{ID: "1.1", NodeID: 2}, {ID: "2.1", NodeID: 2}, {ID: "3.1", NodeID: 1}}
+	return subs, pubs
+}
+
+func clientIDs(subs []*SubClient, pubs []*PubClient) string {
+	var ids []string
+	for _, c := range subs {
+		ids = append(ids, "s"+c.ID)
+	}
+	for _, c := range pubs {
+		ids = append(ids, "p"+c.ID)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestCoordinatorSplit(t *testing.T) {
+	subs, pubs := testClients()
+	c, err := newCoordinator([]string{"host1:7070", " http://host2:7070/ ", ""}, "client", RunSettings{}, subs, pubs, nil, make(chan bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"http://host1:7070", "http://host2:7070"}; !reflect.DeepEqual(c.Agents, want) {
+		t.Errorf("agents %v, want %v", c.Agents, want)
+	}
+	for k, want := range []string{"s1.1 s3.1 p1.1 p3.1", "s2.1 p2.1"} {
+		if got := clientIDs(c.subs[k], c.pubs[k]); got != want {
+			t.Errorf("client split, agent %v: %v, want %v", k, got, want)
+		}
+	}
+
+	c, err = newCoordinator([]string{"host1:7070", "host2:7070"}, "node", RunSettings{}, subs, pubs, nil, make(chan bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range []string{"s1.1 s3.1 p3.1", "s2.1 p1.1 p2.1"} {
+		if got := clientIDs(c.subs[k], c.pubs[k]); got != want {
+			t.Errorf("node split, agent %v: %v, want %v", k, got, want)
+		}
+	}
+
+	if _, err := newCoordinator([]string{"host1:7070"}, "topic", RunSettings{}, subs, pubs, nil, make(chan bool)); err == nil {
+		t.Error("unknown split: no error")
+	}
+	if _, err := newCoordinator([]string{" "}, "client", RunSettings{}, subs, pubs, nil, make(chan bool)); err == nil {
+		t.Error("no agent: no error")
+	}
+}
+
+func TestCoordinatorRun(t *testing.T) {
+	agents := []*stubAgent{{}, {}}
+	var addrs []string
+	for _, a := range agents {
+		server := httptest.NewServer(a)
+		defer server.Close()
+		addrs = append(addrs, server.URL)
+	}
+	subs, pubs := testClients()
+	c, err := newCoordinator(addrs, "node", RunSettings{Quiet: true}, subs, pubs, nil, make(chan bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Subscribe()
+	pubresults := c.Publish()
+	subresults := c.Finish()
+
+	for k, a := range agents {
+		if want := []string{"/subscribe", "/publish", "/finish"}; !reflect.DeepEqual(a.phases(), want) {
+			t.Errorf("agent %v phases %v, want %v", k, a.phases(), want)
+		}
+		if got, want := clientIDs(a.subs, a.pubs), clientIDs(c.subs[k], c.pubs[k]); got != want {
+			t.Errorf("agent %v ran %v, want %v", k, got, want)
+		}
+	}
+
+	var ids []string
+	for _, res := range pubresults {
+		ids = append(ids, res.ID)
+		if res.PubHist == nil || res.PubHist.Count != 1 || res.RTTHist == nil || res.RTTHist.Count != 1 {
+			t.Errorf("publisher %v: histograms not merged", res.ID)
+		}
+	}
+	sort.Strings(ids)
+	if want := []string{"1.1", "2.1", "3.1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("publisher results %v, want %v", ids, want)
+	}
+	ids = nil
+	for _, res := range subresults {
+		ids = append(ids, res.ID)
+		if res.FwdHist == nil || res.FwdHist.Count != 1 || res.SameNodeHist == nil || res.SameNodeHist.Count != 1 || res.CrossNodeHist == nil {
+			t.Errorf("subscriber %v: histograms not merged", res.ID)
+		}
+	}
+	sort.Strings(ids)
+	if want := []string{"1.1", "2.1", "3.1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("subscriber results %v, want %v", ids, want)
+	}
+
+	for _, res := range c.clockResults() {
+		// the estimate taken after the run is not applied
+		if res.Estimates != 2 || res.Applied != 1 {
+			t.Errorf("agent %v: %v clock estimates, %v applied, want 2 and 1", res.Agent, res.Estimates, res.Applied)
+		}
+	}
+	if failed := c.failedAgents(); len(failed) != 0 {
+		t.Errorf("failed agents %v", failed)
+	}
+}
+
+func TestCoordinatorAbort(t *testing.T) {
+	agents := []*stubAgent{{}, {failOn: "/subscribe"}}
+	var addrs []string
+	for _, a := range agents {
+		server := httptest.NewServer(a)
+		defer server.Close()
+		addrs = append(addrs, server.URL)
+	}
+	subs, pubs := testClients()
+	c, err := newCoordinator(addrs, "client", RunSettings{Quiet: true}, subs, pubs, nil, make(chan bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Subscribe()
+	if res := c.Publish(); res != nil {
+		t.Errorf("publish after an abort returned %v results", len(res))
+	}
+	c.Finish()
+
+	if failed := c.failedAgents(); !reflect.DeepEqual(failed, []string{addrs[1]}) {
+		t.Errorf("failed agents %v, want %v", failed, addrs[1:])
+	}
+	// the interruption is forwarded asynchronously
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		phases := agents[0].phases()
+		interrupted := false
+		for _, p := range phases {
+			interrupted = interrupted || p == "/interrupt"
+			if p == "/publish" {
+				t.Fatalf("agent published after the abort: %v", phases)
+			}
+		}
+		if interrupted {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("agent not interrupted: %v", agents[0].phases())
+}
+
+func TestAgentReplacesStaleRun(t *testing.T) {
+	a := &agent{metrics: NewMetrics()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subscribe", a.subscribe)
+	mux.HandleFunc("/finish", a.finish)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c := &Coordinator{Agents: []string{server.URL}}
+
+	job := agentJob{Settings: RunSettings{Quiet: true, Unit: "ms"}}
+	if err := c.post(0, "/subscribe", job, nil); err != nil {
+		t.Fatal(err)
+	}
+	stale := a.run
+	// the coordinator of the first run is gone: a new one subscribes
+	if err := c.post(0, "/subscribe", job, nil); err != nil {
+		t.Fatalf("subscribe over a stale run: %v", err)
+	}
+	if a.run == stale || !closed(stale.Interrupt) {
+		t.Error("stale run not replaced and interrupted")
+	}
+	if err := c.post(0, "/finish", nil, &[]agentSubResult{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.post(0, "/finish", nil, nil); err == nil {
+		t.Error("finish without a run: no error")
+	}
+}
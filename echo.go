@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// echoWait bounds the wait of a publisher for the echoes of a message, after which the echoes
+// still missing are counted as such and the late ones ignored
+const echoWait = time.Second
+
+// echoTopic returns the reply topic of the publisher with the given number
+func echoTopic(pubNum uint32) string {
+	return fmt.Sprintf("mqtt_bench/echo/%d", pubNum)
+}
+
+// echoKey identifies a message of a publisher
+type echoKey struct {
+	topic uint32
+	seq   uint64
+}
+
+// pendingEcho is a message waiting for the echoes of the responders
+type pendingEcho struct {
+	sent   time.Time
+	echoes int
+}
+
+// echoTracker matches the echoes received by a publisher with the messages it sent. The round trip
+// is measured from the local send time of the message, so it does not depend on any clock correction.
+type echoTracker struct {
+	mu         sync.Mutex
+	responders int
+	window     *Window
+	pending    map[echoKey]*pendingEcho
+	expired    time.Time // last expiry of the pending messages
+	missing    int64
+	rtt        *Histogram
+}
+
+func newEchoTracker(responders int, window *Window) *echoTracker {
+	return &echoTracker{
+		responders: responders,
+		window:     window,
+		pending:    make(map[echoKey]*pendingEcho),
+		rtt:        NewHistogram(),
+	}
+}
+
+// sent registers a message before its publication, as its echoes can arrive before the acknowledgement
+func (t *echoTracker) sent(h Header, at time.Time) {
+	t.mu.Lock()
+	t.pending[echoKey{h.Topic, h.Seq}] = &pendingEcho{sent: at}
+	if at.Sub(t.expired) > echoWait {
+		t.expire(at.Add(-echoWait))
+		t.expired = at
+	}
+	t.mu.Unlock()
+}
+
+// expire forgets the messages sent before cutoff and counts their missing echoes, t.mu must be held
+func (t *echoTracker) expire(cutoff time.Time) {
+	for key, p := range t.pending {
+		if !p.sent.Before(cutoff) {
+			continue
+		}
+		if t.window.contains(p.sent.UnixNano()) {
+			t.missing += int64(t.responders - p.echoes)
+		}
+		delete(t.pending, key)
+	}
+}
+
+// failed forgets a message whose publication failed
+func (t *echoTracker) failed(h Header) {
+	t.mu.Lock()
+	delete(t.pending, echoKey{h.Topic, h.Seq})
+	t.mu.Unlock()
+}
+
+// echo records the round trip of an echo received at at; messages sent outside the measurement
+// window are not measured
+func (t *echoTracker) echo(h Header, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := echoKey{h.Topic, h.Seq}
+	p, ok := t.pending[key]
+	if !ok {
+		return
+	}
+	if t.window.contains(p.sent.UnixNano()) {
+		t.rtt.Record(at.Sub(p.sent))
+	}
+	p.echoes++
+	if p.echoes >= t.responders {
+		delete(t.pending, key)
+	}
+}
+
+// wait waits for the echoes of the messages sent, at most timeout
+func (t *echoTracker) wait(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		t.mu.Lock()
+		n := len(t.pending)
+		t.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// result returns the round trip histogram and the number of echoes missing, those of the
+// messages still pending included
+func (t *echoTracker) result() (*Histogram, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(time.Now())
+	return t.rtt, t.missing
+}
+
+// EchoClient is an echo responder: it subscribes to the benchmark topics and republishes every
+// message unchanged, header included, to the reply topic of its publisher. The publisher then
+// measures the round trip on its own clock.
+type EchoClient struct {
+	ID          string
+	NodeID      int
+	BrokerURLs  []string
+	BrokerUser  string
+	BrokerPass  string
+	TLS         *TLSSettings
+	Headers     map[string]string
+	Subprotocol string
+	Topics      map[string]byte
+	PubQoS      byte
+	Quiet       bool
+	// set by the Run executing the responder
+	Metrics *Metrics `json:"-"`
+}
+
+func (c *EchoClient) run(echoDone chan bool, jobDone chan bool) {
+	var echoed, invalid int64
+	opts := mqtt.NewClientOptions().
+		SetClientID(fmt.Sprintf("echo-%v", c.ID)).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+			header, err := decodeHeader(msg.Payload())
+			if err != nil {
+				atomic.AddInt64(&invalid, 1)
+				return
+			}
+			client.Publish(echoTopic(header.PubNum), c.PubQoS, false, msg.Payload())
+			atomic.AddInt64(&echoed, 1)
+		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			c.Metrics.connect()
+		}).
+		SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+			c.Metrics.connectionLost(c.NodeID, "echo")
+			log.Printf("Echo-%v lost connection to the broker: %v. Will reconnect...\n", c.ID, reason.Error())
+		})
+	for _, brokerURL := range c.BrokerURLs {
+		opts.AddBroker(brokerURL)
+	}
+	if c.BrokerUser != "" && c.BrokerPass != "" {
+		opts.SetUsername(c.BrokerUser)
+		opts.SetPassword(c.BrokerPass)
+	}
+	setupWebsocket(opts, c.Headers, c.Subprotocol)
+	// the TLS files were checked before the run started
+	if err := setupTLS(opts, c.TLS); err != nil {
+		log.Printf("Echo-%v had error setting up TLS: %v\n", c.ID, err)
+		return
+	}
+	client := mqtt.NewClient(opts)
+
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Printf("Echo-%v had error connecting to the broker: %v\n", c.ID, token.Error())
+		return
+	}
+	if token := client.SubscribeMultiple(c.Topics, nil); token.Wait() && token.Error() != nil {
+		log.Printf("Echo-%v had error in subscribing to topics. Error: %v\n", c.ID, token.Error())
+		return
+	}
+	if !c.Quiet {
+		log.Printf("Echo-%v connected to broker: %v\n", c.ID, c.BrokerURLs)
+	}
+
+	echoDone <- true
+	<-jobDone
+	c.Metrics.disconnect()
+	client.Disconnect(250)
+	if !c.Quiet {
+		log.Printf("Echo-%v echoed %v messages (%v invalid)\n", c.ID, atomic.LoadInt64(&echoed), atomic.LoadInt64(&invalid))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+// flowKey identifies the messages of a publisher on a topic
+type flowKey struct {
+	pubID uint32
+	topic uint32
+}
+
+// flow follows the sequence numbers received on a single flow
+type flow struct {
+	highest uint64
+	started bool
+	// missing holds the sequence numbers skipped so far, that may still arrive late
+	missing map[uint64]bool
+}
+
+// flowTracker detects lost, duplicated and reordered messages on every flow received by a subscriber.
+// Sequence numbers start at 0 on every flow; a message below the highest received one is either a
+// late arrival filling a gap (reordered) or a duplicate. Messages lost after the last one received
+// on a flow cannot be told apart from messages never sent and are not counted.
+type flowTracker struct {
+	flows      map[flowKey]*flow
+	duplicates int64
+	reordered  int64
+	reorderSum uint64
+	reorderMax uint64
+	missing    int64
+}
+
+func newFlowTracker() *flowTracker {
+	return &flowTracker{flows: make(map[flowKey]*flow)}
+}
+
+// add records the arrival of a message
+func (t *flowTracker) add(h Header) {
+	key := flowKey{h.PubNum, h.Topic}
+	f, ok := t.flows[key]
+	if !ok {
+		f = &flow{missing: make(map[uint64]bool)}
+		t.flows[key] = f
+	}
+
+	switch {
+	case !f.started || h.Seq > f.highest:
+		start := f.highest + 1
+		if !f.started {
+			start = 0
+		}
+		for seq := start; seq < h.Seq; seq++ {
+			f.missing[seq] = true
+		}
+		t.missing += int64(h.Seq - start)
+		f.highest = h.Seq
+		f.started = true
+	case f.missing[h.Seq]:
+		delete(f.missing, h.Seq)
+		t.missing--
+		distance := f.highest - h.Seq
+		t.reordered++
+		t.reorderSum += distance
+		if distance > t.reorderMax {
+			t.reorderMax = distance
+		}
+	default:
+		t.duplicates++
+	}
+}
+
+// lost returns the number of messages still missing on all the flows
+func (t *flowTracker) lost() int64 {
+	return t.missing
+}
+
+// reorderMean returns the mean distance, in sequence numbers, of the reordered messages
+func (t *flowTracker) reorderMean() float64 {
+	if t.reordered == 0 {
+		return 0
+	}
+	return float64(t.reorderSum) / float64(t.reordered)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/rand"
+)
+
+// PlacementParams describes the population to be placed on the cluster
+type PlacementParams struct {
+	Algorithm    string
+	Publishers   int
+	Subscribers  int
+	Topics       int
+	TopicsPerSub int
+	Nodes        int
+	Popularity   string
+	ZipfS        float64
+	Seed         uint64
+	Gamma        float64
+	Sessions     int
+	Rate         float64
+	Rates        []float64
+}
+
+// topicRates returns lambda_v, indexed by topic
+func (p PlacementParams) topicRates() []float64 {
+	if p.Rates != nil {
+		return p.Rates
+	}
+	rates := make([]float64, p.Topics+1)
+	for t := 1; t <= p.Topics; t++ {
+		rates[t] = p.Rate
+	}
+	return rates
+}
+
+// loadTopicRates reads a JSON object mapping topics to their publication rate (msg/sec).
+// Topics missing from the file get defaultRate.
+func loadTopicRates(fileName string, topics int, defaultRate float64) ([]float64, error) {
+	file, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("reading rates file: %v", err)
+	}
+	var byTopic map[string]float64
+	if err := json.Unmarshal(file, &byTopic); err != nil {
+		return nil, fmt.Errorf("parsing rates file: %v", err)
+	}
+
+	rates := make([]float64, topics+1)
+	for t := 1; t <= topics; t++ {
+		rates[t] = defaultRate
+	}
+	for key, rate := range byTopic {
+		t, err := strconv.Atoi(key)
+		if err != nil || t < 1 || t > topics {
+			return nil, fmt.Errorf("invalid topic %q in rates file", key)
+		}
+		if !(rate > 0) || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("invalid rate %v for topic %q in rates file", rate, key)
+		}
+		rates[t] = rate
+	}
+	return rates, nil
+}
+
+// place places the clients with the selected algorithm
+func place(p PlacementParams) (Users, error) {
+	switch strings.ToLower(p.Algorithm) {
+	case "random":
+		return randomAttach(p)
+	case "greedy":
+		return greedyPlacement(p)
+	default:
+		return Users{}, fmt.Errorf("unknown placement algorithm %q", p.Algorithm)
+	}
+}
+
+// topicSampler draws topics in [1, n] according to a popularity distribution
+type topicSampler struct {
+	cdf []float64
+	r   *rand.Rand
+}
+
+func newTopicSampler(p PlacementParams, r *rand.Rand) (*topicSampler, error) {
+	weights := make([]float64, p.Topics)
+	switch strings.ToLower(p.Popularity) {
+	case "uniform":
+		for i := range weights {
+			weights[i] = 1
+		}
+	case "zipf":
+		for i := range weights {
+			weights[i] = 1 / math.Pow(float64(i+1), p.ZipfS)
+		}
+	default:
+		return nil, fmt.Errorf("unknown topic popularity %q", p.Popularity)
+	}
+
+	cdf := make([]float64, len(weights))
+	total := 0.0
+	for i, w := range weights {
+		total += w
+		cdf[i] = total
+	}
+	for i := range cdf {
+		cdf[i] /= total
+	}
+	return &topicSampler{cdf: cdf, r: r}, nil
+}
+
+func (s *topicSampler) next() int {
+	return sort.SearchFloat64s(s.cdf, s.r.Float64()) + 1
+}
+
+// topicList draws n distinct topics
+func (s *topicSampler) topicList(n int) []int {
+	if n > len(s.cdf) {
+		n = len(s.cdf)
+	}
+	seen := make(map[int]bool, n)
+	list := make([]int, 0, n)
+	for len(list) < n {
+		t := s.next()
+		if !seen[t] {
+			seen[t] = true
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// publisherTopic returns the topic owned by the h-th publisher (1-based)
+func publisherTopic(h int, topics int) int {
+	return (h-1)%topics + 1
+}
+
+// subscriberTopicLists draws the topic list of every subscriber
+func subscriberTopicLists(p PlacementParams, r *rand.Rand) ([][]int, error) {
+	sampler, err := newTopicSampler(p, r)
+	if err != nil {
+		return nil, err
+	}
+	lists := make([][]int, p.Subscribers)
+	for j := range lists {
+		lists[j] = sampler.topicList(p.TopicsPerSub)
+	}
+	return lists, nil
+}
+
+// placePublishers attaches every publisher to the first node that already has a subscriber
+// of its topic, or to a random node when there is none. ns[t][k] counts the subscribers of
+// topic t on node k.
+func placePublishers(p PlacementParams, ns map[int][]int, r *rand.Rand) []Publisher {
+	publishers := make([]Publisher, p.Publishers)
+	for h := 1; h <= p.Publishers; h++ {
+		t := publisherTopic(h, p.Topics)
+		k := 0
+		for node, n := range ns[t] {
+			if n > 0 {
+				k = node + 1
+				break
+			}
+		}
+		if k == 0 {
+			k = r.Intn(p.Nodes) + 1
+		}
+		publishers[h-1] = Publisher{
+			PubID:     sessionID(h, 1),
+			NodeID:    k,
+			TopicList: []int{t},
+		}
+	}
+	return publishers
+}
+
+// randomAttach places the clients following the random-attach algorithm:
+// each subscriber goes to a random node and publishers follow their subscribers.
+func randomAttach(p PlacementParams) (Users, error) {
+	var user Users
+	r := rand.New(rand.NewSource(p.Seed))
+
+	lists, err := subscriberTopicLists(p, r)
+	if err != nil {
+		return user, err
+	}
+
+	ns := make(map[int][]int)
+	for j, t := range lists {
+		k := r.Intn(p.Nodes) + 1
+		for _, top := range t {
+			if ns[top] == nil {
+				ns[top] = make([]int, p.Nodes)
+			}
+			ns[top][k-1]++
+		}
+		user.Subscribers = append(user.Subscribers, Subscriber{
+			SubID:     sessionID(j+1, 1),
+			NodeID:    k,
+			TopicList: t,
+		})
+	}
+
+	user.Publishers = placePublishers(p, ns, r)
+	return user, nil
+}
+
+// maxSessions is the largest number of sessions per subscriber that sessionID can encode
+const maxSessions = 9
+
+// sessionID builds the "client.session" identifier used in the clients file. The session is a
+// single decimal digit, as 1.10 would read back as 1.1: parsePlacementFlags bounds -sessions.
+func sessionID(client int, session int) float64 {
+	id, _ := strconv.ParseFloat(fmt.Sprintf("%d.%d", client, session), 64)
+	return id
+}
+
+// writeUsers writes the clients file in the same layout produced by the MATLAB scripts
+func writeUsers(w io.Writer, user Users) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "{ \"publisher\" : \n[\n")
+	for i, pub := range user.Publishers {
+		fmt.Fprintf(bw, "{\"pub_id\" : %v , \"node_id\" : %d , \"topic_list\" : %v}", formatID(pub.PubID), pub.NodeID, formatTopicList(pub.TopicList))
+		if i != len(user.Publishers)-1 {
+			fmt.Fprintf(bw, ",\n")
+		}
+	}
+	fmt.Fprintf(bw, "], \"subscriber\" : \n[\n")
+	for i, sub := range user.Subscribers {
+		fmt.Fprintf(bw, "{\"sub_id\" : %v , \"node_id\" : %d , \"topic_list\" : %v}", formatID(sub.SubID), sub.NodeID, formatTopicList(sub.TopicList))
+		if i != len(user.Subscribers)-1 {
+			fmt.Fprintf(bw, ",\n")
+		}
+	}
+	fmt.Fprintf(bw, "]}\n")
+	return bw.Flush()
+}
+
+func formatID(id float64) string {
+	return strconv.FormatFloat(id, 'f', -1, 64)
+}
+
+func formatTopicList(topics []int) string {
+	s := make([]string, len(topics))
+	for i, t := range topics {
+		s[i] = strconv.Itoa(t)
+	}
+	return "[" + strings.Join(s, ",") + "]"
+}
+
+// parsePlacementFlags parses the placement parameters shared by the "generate" subcommand
+// and the -placement flag.
+func parsePlacementFlags(fs *flag.FlagSet, args []string) (PlacementParams, error) {
+	var (
+		algorithm    = fs.String("algorithm", "random", "Placement algorithm: random or greedy.")
+		pubs         = fs.Int("pubs", 1000, "Number of publishers.")
+		subs         = fs.Int("subs", 100, "Number of subscribers.")
+		topics       = fs.Int("topics", 0, "Number of topics (default one per publisher).")
+		topicsPerSub = fs.Int("topics-per-sub", 10, "Number of topics each subscriber is interested in.")
+		nodes        = fs.Int("nodes", 1, "Number of broker nodes (M).")
+		popularity   = fs.String("popularity", "zipf", "Topic popularity distribution: uniform or zipf.")
+		zipfS        = fs.Float64("zipf", 1.0, "Exponent of the Zipf topic popularity.")
+		seed         = fs.Uint64("seed", 1, "Seed of the random generator.")
+		gamma        = fs.Float64("gamma", 1.2, "Fairness factor of the greedy algorithm (>= 1).")
+		sessions     = fs.Int("sessions", 1, "Maximum number of sessions per subscriber (Nses) of the greedy algorithm.")
+		rate         = fs.Float64("rate", 1.0, "Publication rate of every topic (msg/sec).")
+		ratesFile    = fs.String("rates", "", "JSON file mapping topics to their publication rate (msg/sec).")
+	)
+	if err := fs.Parse(args); err != nil {
+		return PlacementParams{}, err
+	}
+
+	p := PlacementParams{
+		Algorithm:    *algorithm,
+		Publishers:   *pubs,
+		Subscribers:  *subs,
+		Topics:       *topics,
+		TopicsPerSub: *topicsPerSub,
+		Nodes:        *nodes,
+		Popularity:   *popularity,
+		ZipfS:        *zipfS,
+		Seed:         *seed,
+		Gamma:        *gamma,
+		Sessions:     *sessions,
+		Rate:         *rate,
+	}
+	if p.Publishers < 0 || p.Subscribers < 0 || p.TopicsPerSub < 1 {
+		return p, fmt.Errorf("-pubs and -subs must not be negative, -topics-per-sub must be positive")
+	}
+	if p.Topics == 0 {
+		p.Topics = p.Publishers
+	}
+	if p.Nodes < 1 || p.Topics < 1 || p.Sessions < 1 {
+		return p, fmt.Errorf("-nodes, -topics and -sessions must be positive")
+	}
+	if p.TopicsPerSub > p.Topics {
+		return p, fmt.Errorf("-topics-per-sub must be at most the %d topics", p.Topics)
+	}
+	if p.Sessions > maxSessions {
+		return p, fmt.Errorf("-sessions must be at most %d", maxSessions)
+	}
+	if p.Gamma < 1 {
+		return p, fmt.Errorf("-gamma must be >= 1")
+	}
+	if !(p.Rate > 0) || math.IsInf(p.Rate, 0) {
+		return p, fmt.Errorf("-rate must be positive")
+	}
+	if *ratesFile != "" {
+		rates, err := loadTopicRates(*ratesFile, p.Topics, p.Rate)
+		if err != nil {
+			return p, err
+		}
+		p.Rates = rates
+	}
+	return p, nil
+}
+
+// runGenerate implements the "generate" subcommand
+func runGenerate(args []string) {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	out := fs.String("out", "", "Output file (default stdout).")
+	p, err := parsePlacementFlags(fs, args)
+	if err != nil {
+		log.Fatalf("generate: %v\n", err)
+	}
+
+	user, err := place(p)
+	if err != nil {
+		log.Fatalf("generate: %v\n", err)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("generate: %v\n", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeUsers(w, user); err != nil {
+		log.Fatalf("generate: %v\n", err)
+	}
+}
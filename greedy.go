@@ -0,0 +1,246 @@
+package main
+
+import (
+	"sort"
+
+	"golang.org/x/exp/rand"
+)
+
+// clusterState keeps the number of subscribers (ns) and publishers (np) of every topic on every node
+type clusterState struct {
+	nodes int
+	rates []float64
+	ns    map[int][]int
+	np    map[int][]int
+}
+
+func newClusterState(nodes int, rates []float64) *clusterState {
+	return &clusterState{
+		nodes: nodes,
+		rates: rates,
+		ns:    make(map[int][]int),
+		np:    make(map[int][]int),
+	}
+}
+
+func (s *clusterState) add(counts map[int][]int, topic int, node int) {
+	if counts[topic] == nil {
+		counts[topic] = make([]int, s.nodes)
+	}
+	counts[topic][node-1]++
+}
+
+// rate returns lambda of a topic
+func (s *clusterState) rate(topic int) float64 {
+	if topic < len(s.rates) {
+		return s.rates[topic]
+	}
+	return 0
+}
+
+// active tells whether the topic belongs to Ta of the node
+func (s *clusterState) active(topic int, node int) bool {
+	return (s.ns[topic] != nil && s.ns[topic][node-1] > 0) || (s.np[topic] != nil && s.np[topic][node-1] > 0)
+}
+
+func (s *clusterState) hasPublisher(topic int) bool {
+	for _, n := range s.np[topic] {
+		if n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriberTopicCost is the term of Eq. 1 for a single topic: lambda if the topic is not active
+// on the node and its publisher is connected to the cluster, zero otherwise.
+func (s *clusterState) subscriberTopicCost(topic int, node int) float64 {
+	if !s.active(topic, node) && s.hasPublisher(topic) {
+		return s.rate(topic)
+	}
+	return 0
+}
+
+// subscriberCost is the internal traffic increase of Eq. 1 for a subscriber of topics attached to node
+func (s *clusterState) subscriberCost(topics []int, node int) float64 {
+	cost := 0.0
+	for _, t := range topics {
+		cost += s.subscriberTopicCost(t, node)
+	}
+	return cost
+}
+
+// publisherCost is the internal traffic increase of Eq. 3 for a publisher of topics attached to node:
+// its publications are forwarded to every other node having the topic active.
+func (s *clusterState) publisherCost(topics []int, node int) float64 {
+	cost := 0.0
+	for _, t := range topics {
+		for h := 1; h <= s.nodes; h++ {
+			if h != node && s.active(t, h) {
+				cost += s.rate(t)
+			}
+		}
+	}
+	return cost
+}
+
+// externalIn returns Aei of every node, the publication rate entering from the publishers
+func (s *clusterState) externalIn() []float64 {
+	return s.externalRate(s.np)
+}
+
+// externalOut returns Aeo of every node, the delivery rate towards the subscribers
+func (s *clusterState) externalOut() []float64 {
+	return s.externalRate(s.ns)
+}
+
+func (s *clusterState) externalRate(counts map[int][]int) []float64 {
+	rates := make([]float64, s.nodes)
+	for t, c := range counts {
+		for k, n := range c {
+			rates[k] += s.rate(t) * float64(n)
+		}
+	}
+	return rates
+}
+
+// fairCandidates returns the nodes whose external rate is below gamma times the fair share.
+// All nodes are candidates while no traffic has been placed yet.
+func fairCandidates(rates []float64, gamma float64) []int {
+	total := 0.0
+	for _, r := range rates {
+		total += r
+	}
+	target := gamma * total / float64(len(rates))
+
+	var candidates []int
+	for k, r := range rates {
+		if r < target {
+			candidates = append(candidates, k+1)
+		}
+	}
+	if len(candidates) == 0 {
+		for k := range rates {
+			candidates = append(candidates, k+1)
+		}
+	}
+	return candidates
+}
+
+// bestMatchingSub returns the candidate node with the lowest Eq. 1 cost for the topics,
+// together with the topics whose cost on that node is minimum.
+func (s *clusterState) bestMatchingSub(topics []int, candidates []int) (int, []int) {
+	best := candidates[0]
+	bestCost := s.subscriberCost(topics, best)
+	for _, k := range candidates[1:] {
+		if cost := s.subscriberCost(topics, k); cost < bestCost {
+			best, bestCost = k, cost
+		}
+	}
+
+	minCost := s.subscriberTopicCost(topics[0], best)
+	for _, t := range topics[1:] {
+		if cost := s.subscriberTopicCost(t, best); cost < minCost {
+			minCost = cost
+		}
+	}
+	var matched []int
+	for _, t := range topics {
+		if s.subscriberTopicCost(t, best) == minCost {
+			matched = append(matched, t)
+		}
+	}
+	return best, matched
+}
+
+// greedyPlacement places the clients following the best-matching greedy algorithm.
+// Publishers are attached first to the node of minimum Eq. 3 cost among those satisfying the
+// incoming fairness constraint, then each subscriber's topics are split over at most
+// p.Sessions nodes, minimizing Eq. 1 among those satisfying the outgoing fairness constraint.
+func greedyPlacement(p PlacementParams) (Users, error) {
+	var user Users
+	r := rand.New(rand.NewSource(p.Seed))
+
+	lists, err := subscriberTopicLists(p, r)
+	if err != nil {
+		return user, err
+	}
+	rates := p.topicRates()
+	state := newClusterState(p.Nodes, rates)
+
+	for h := 1; h <= p.Publishers; h++ {
+		topics := []int{publisherTopic(h, p.Topics)}
+		candidates := fairCandidates(state.externalIn(), p.Gamma)
+		var best []int
+		bestCost := 0.0
+		for _, k := range candidates {
+			cost := state.publisherCost(topics, k)
+			if len(best) == 0 || cost < bestCost {
+				best, bestCost = []int{k}, cost
+			} else if cost == bestCost {
+				best = append(best, k)
+			}
+		}
+		k := best[r.Intn(len(best))]
+		state.add(state.np, topics[0], k)
+		user.Publishers = append(user.Publishers, Publisher{
+			PubID:     sessionID(h, 1),
+			NodeID:    k,
+			TopicList: topics,
+		})
+	}
+
+	candidates := fairCandidates(state.externalOut(), p.Gamma)
+	for j, tc := range lists {
+		sessions := make(map[int][]int)
+		var used []int
+		tna := tc
+		for len(tna) > 0 {
+			k, matched := state.bestMatchingSub(tna, candidates)
+			tna = difference(tna, matched)
+			if _, ok := sessions[k]; !ok {
+				used = append(used, k)
+			}
+			sessions[k] = append(sessions[k], matched...)
+			for _, t := range matched {
+				state.add(state.ns, t, k)
+			}
+			if len(used) == p.Sessions {
+				sessions[k] = append(sessions[k], tna...)
+				for _, t := range tna {
+					state.add(state.ns, t, k)
+				}
+				tna = nil
+			}
+			candidates = fairCandidates(state.externalOut(), p.Gamma)
+		}
+
+		sort.Ints(used)
+		for s, k := range used {
+			topics := sessions[k]
+			sort.Ints(topics)
+			user.Subscribers = append(user.Subscribers, Subscriber{
+				SubID:     sessionID(j+1, s+1),
+				NodeID:    k,
+				TopicList: topics,
+			})
+		}
+	}
+
+	return user, nil
+}
+
+// difference returns the elements of a that are not in b
+func difference(a []int, b []int) []int {
+	remove := make(map[int]bool, len(b))
+	for _, x := range b {
+		remove[x] = true
+	}
+	var diff []int
+	for _, x := range a {
+		if !remove[x] {
+			diff = append(diff, x)
+		}
+	}
+	return diff
+}
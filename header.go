@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Every benchmark message starts with a fixed binary header (big endian):
+//
+//	offset size field
+//	0      4    magic "MQBH"
+//	4      1    version
+//	5      1    flags (headerCRC: the body checksum is set)
+//	6      4    publisher number (position in the clients file)
+//	10     4    topic
+//	14     8    sequence number of the message on the publisher topic
+//	22     8    send time (Unix nanoseconds)
+//	30     4    CRC-32 (IEEE) of the body, 0 when not set
+//
+// and is followed by the body, so that the payload has exactly the configured size.
+const (
+	headerMagic   = 0x4d514248
+	headerVersion = 1
+	headerSize    = 34
+
+	headerCRC = 1 << 0
+)
+
+// Header describes the benchmark header of a message
+type Header struct {
+	PubNum   uint32
+	Topic    uint32
+	Seq      uint64
+	SendTime int64
+	CRC      bool
+}
+
+// encode returns the payload made of the header followed by body
+func (h Header) encode(body []byte) []byte {
+	payload := make([]byte, headerSize+len(body))
+	binary.BigEndian.PutUint32(payload[0:], headerMagic)
+	payload[4] = headerVersion
+	binary.BigEndian.PutUint32(payload[6:], h.PubNum)
+	binary.BigEndian.PutUint32(payload[10:], h.Topic)
+	binary.BigEndian.PutUint64(payload[14:], h.Seq)
+	binary.BigEndian.PutUint64(payload[22:], uint64(h.SendTime))
+	if h.CRC {
+		payload[5] |= headerCRC
+		binary.BigEndian.PutUint32(payload[30:], crc32.ChecksumIEEE(body))
+	}
+	copy(payload[headerSize:], body)
+	return payload
+}
+
+// decodeHeader reads the header of a payload and checks the body checksum, if any
+func decodeHeader(payload []byte) (Header, error) {
+	var h Header
+	if len(payload) < headerSize {
+		return h, fmt.Errorf("payload of %v bytes is shorter than the header", len(payload))
+	}
+	if binary.BigEndian.Uint32(payload[0:]) != headerMagic {
+		return h, fmt.Errorf("bad magic")
+	}
+	if payload[4] != headerVersion {
+		return h, fmt.Errorf("unsupported header version %v", payload[4])
+	}
+	h.PubNum = binary.BigEndian.Uint32(payload[6:])
+	h.Topic = binary.BigEndian.Uint32(payload[10:])
+	h.Seq = binary.BigEndian.Uint64(payload[14:])
+	h.SendTime = int64(binary.BigEndian.Uint64(payload[22:]))
+	if payload[5]&headerCRC != 0 {
+		h.CRC = true
+		if crc32.ChecksumIEEE(payload[headerSize:]) != binary.BigEndian.Uint32(payload[30:]) {
+			return h, fmt.Errorf("body checksum mismatch")
+		}
+	}
+	return h, nil
+}
+
+// bodySize returns the size of the body of a payload of the given total size
+func bodySize(size int) int {
+	if size < headerSize {
+		return 0
+	}
+	return size - headerSize
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	sent := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+	body := []byte("0123456789abcdef")
+	for _, crc := range []bool{false, true} {
+		h := Header{PubNum: 7, Topic: 42, Seq: 1 << 40, SendTime: sent.UnixNano(), CRC: crc}
+		payload := h.encode(body)
+		if len(payload) != headerSize+len(body) {
+			t.Fatalf("crc %v: payload of %v bytes, want %v", crc, len(payload), headerSize+len(body))
+		}
+		got, err := decodeHeader(payload)
+		if err != nil {
+			t.Fatalf("crc %v: %v", crc, err)
+		}
+		if got != h {
+			t.Errorf("crc %v: decoded %+v, want %+v", crc, got, h)
+		}
+		if !bytes.Equal(payload[headerSize:], body) {
+			t.Errorf("crc %v: body %q, want %q", crc, payload[headerSize:], body)
+		}
+
+		// without clock correction the latency is the receive time minus the send time of the header
+		if _, latency, err := new(SubClient).latency(payload, sent.Add(1500*time.Microsecond)); err != nil || latency != 1500*time.Microsecond {
+			t.Errorf("crc %v: latency %v, %v, want 1.5ms", crc, latency, err)
+		}
+	}
+}
+
+func TestHeaderClockCorrection(t *testing.T) {
+	// the publisher clock is 2ms ahead of the coordinator, the subscriber clock 3ms behind
+	pubClock, subClock := new(Clock), new(Clock)
+	pubClock.set(ClockSync{Offset: int64(2 * time.Millisecond)})
+	subClock.set(ClockSync{Offset: -int64(3 * time.Millisecond)})
+
+	sent := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := Header{SendTime: pubClock.reference(sent.Add(2 * time.Millisecond).UnixNano())}
+	sub := &SubClient{Clock: subClock}
+	received := sent.Add(-3*time.Millisecond + 800*time.Microsecond)
+	got, latency, err := sub.latency(h.encode(nil), received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != h {
+		t.Errorf("decoded %+v, want %+v", got, h)
+	}
+	if latency != 800*time.Microsecond {
+		t.Errorf("latency %v, want 800µs", latency)
+	}
+	// uncorrected, the latency would lose the 3ms the subscriber clock is behind
+	if _, latency, _ := new(SubClient).latency(h.encode(nil), received); latency != 800*time.Microsecond-3*time.Millisecond {
+		t.Errorf("uncorrected latency %v, want -2.2ms", latency)
+	}
+
+	if _, _, err := sub.latency([]byte("not a benchmark message"), received); err == nil {
+		t.Error("invalid payload: no error")
+	}
+}
+
+func TestHeaderErrors(t *testing.T) {
+	h := Header{PubNum: 1, Topic: 2, Seq: 3, SendTime: 4, CRC: true}
+
+	corrupted := h.encode([]byte("payload"))
+	corrupted[len(corrupted)-1] ^= 0xff
+	if _, err := decodeHeader(corrupted); err == nil {
+		t.Error("corrupted body: no error")
+	}
+
+	// without the CRC flag the body is not checked
+	unchecked := Header{PubNum: 1}.encode([]byte("payload"))
+	unchecked[len(unchecked)-1] ^= 0xff
+	if _, err := decodeHeader(unchecked); err != nil {
+		t.Errorf("body without CRC: %v", err)
+	}
+
+	badMagic := h.encode(nil)
+	badMagic[0] = 'X'
+	if _, err := decodeHeader(badMagic); err == nil {
+		t.Error("bad magic: no error")
+	}
+
+	badVersion := h.encode(nil)
+	badVersion[4] = headerVersion + 1
+	if _, err := decodeHeader(badVersion); err == nil {
+		t.Error("bad version: no error")
+	}
+
+	if _, err := decodeHeader(h.encode(nil)[:headerSize-1]); err == nil {
+		t.Error("short payload: no error")
+	}
+}
+
+func TestBodySize(t *testing.T) {
+	for _, c := range []struct{ size, body int }{{0, 0}, {headerSize - 1, 0}, {headerSize, 0}, {100, 100 - headerSize}} {
+		if got := bodySize(c.size); got != c.body {
+			t.Errorf("bodySize(%v) = %v, want %v", c.size, got, c.body)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// histogramSubBits sets the precision of the histogram: every power of two range is split
+// in 2^(histogramSubBits-1) buckets, i.e. a relative error below 1/64.
+const histogramSubBits = 7
+
+// Histogram is a mergeable high-dynamic-range histogram of durations. Its memory is
+// bounded by the logarithm of the largest recorded value, whatever the number of samples.
+// Count, sum, min and max are exact, quantiles have a relative error below 1/64.
+type Histogram struct {
+	Counts []uint64 `json:"counts"`
+	Count  uint64   `json:"count"`
+	Min    int64    `json:"min"`
+	Max    int64    `json:"max"`
+	Sum    float64  `json:"sum"`
+	SumSq  float64  `json:"sum_sq"`
+}
+
+// NewHistogram returns an empty histogram
+func NewHistogram() *Histogram {
+	return &Histogram{}
+}
+
+// histogramIndex returns the bucket of a value: values below 2^histogramSubBits have their own
+// bucket, larger values are grouped by power of two and by their next most significant bits.
+func histogramIndex(v uint64) int {
+	b := bits.Len64(v >> histogramSubBits)
+	return b<<(histogramSubBits-1) + int(v>>uint(b))
+}
+
+// histogramValue returns the value in the middle of a bucket
+func histogramValue(i int) int64 {
+	half := 1 << (histogramSubBits - 1)
+	if i < 2*half {
+		return int64(i)
+	}
+	b := uint(i/half - 1)
+	sub := int64(i%half + half)
+	return sub<<b + (int64(1)<<b)/2
+}
+
+// Record adds a duration to the histogram. Negative durations are recorded as 0.
+func (h *Histogram) Record(d time.Duration) {
+	v := int64(d)
+	if v < 0 {
+		v = 0
+	}
+	i := histogramIndex(uint64(v))
+	if i >= len(h.Counts) {
+		counts := make([]uint64, i+1)
+		copy(counts, h.Counts)
+		h.Counts = counts
+	}
+	h.Counts[i]++
+
+	if h.Count == 0 || v < h.Min {
+		h.Min = v
+	}
+	if v > h.Max {
+		h.Max = v
+	}
+	h.Count++
+	h.Sum += float64(v)
+	h.SumSq += float64(v) * float64(v)
+}
+
+// Merge adds all the samples of o to the histogram
+func (h *Histogram) Merge(o *Histogram) {
+	if o == nil || o.Count == 0 {
+		return
+	}
+	if len(o.Counts) > len(h.Counts) {
+		counts := make([]uint64, len(o.Counts))
+		copy(counts, h.Counts)
+		h.Counts = counts
+	}
+	for i, n := range o.Counts {
+		h.Counts[i] += n
+	}
+	if h.Count == 0 || o.Min < h.Min {
+		h.Min = o.Min
+	}
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+	h.SumSq += o.SumSq
+}
+
+// Quantile returns the value below which a fraction q of the samples falls
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range h.Counts {
+		seen += n
+		if seen >= rank {
+			v := histogramValue(i)
+			// the exact extremes are known
+			if v < h.Min {
+				v = h.Min
+			}
+			if v > h.Max {
+				v = h.Max
+			}
+			return time.Duration(v)
+		}
+	}
+	return time.Duration(h.Max)
+}
+
+// Mean returns the exact mean of the samples
+func (h *Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return time.Duration(h.Sum / float64(h.Count))
+}
+
+// Std returns the exact sample standard deviation of the samples
+func (h *Histogram) Std() time.Duration {
+	if h.Count < 2 {
+		return 0
+	}
+	n := float64(h.Count)
+	variance := (h.SumSq - h.Sum*h.Sum/n) / (n - 1)
+	return time.Duration(math.Sqrt(math.Max(variance, 0)))
+}
+
+// Percentiles describes the latency distribution reported for a client or a total, in latencyUnit
+type Percentiles struct {
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	P999  float64 `json:"p99_9"`
+	P9999 float64 `json:"p99_99"`
+}
+
+// Percentiles returns the reported percentiles of the histogram in latencyUnit
+func (h *Histogram) Percentiles() Percentiles {
+	return Percentiles{
+		P50:   inUnit(h.Quantile(0.5)),
+		P90:   inUnit(h.Quantile(0.9)),
+		P99:   inUnit(h.Quantile(0.99)),
+		P999:  inUnit(h.Quantile(0.999)),
+		P9999: inUnit(h.Quantile(0.9999)),
+	}
+}
+
+// latencyUnit is the unit of all the reported latencies
+var latencyUnit = time.Millisecond
+
+// latencyUnits maps the names accepted by -unit to their duration
+var latencyUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+}
+
+// unitName returns the name of latencyUnit
+func unitName() string {
+	for name, unit := range latencyUnits {
+		if unit == latencyUnit {
+			return name
+		}
+	}
+	return latencyUnit.String()
+}
+
+// inUnit converts a duration to latencyUnit
+func inUnit(d time.Duration) float64 {
+	return float64(d) / float64(latencyUnit)
+}
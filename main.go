@@ -4,9 +4,12 @@ import (
 	"flag"
 	"fmt"
 	"github.com/GaryBoone/GoStats/stats"
+	"io"
 	"log"
-	"math"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,7 +17,12 @@ import (
 type Message struct {
 	Topic     string
 	QoS       byte
+	Retain    bool
+	Body      []byte
 	Payload   interface{}
+	Seq       uint64
+	Offset    time.Duration
+	Scheduled time.Time
 	Sent      time.Time
 	Delivered time.Time
 	Error     bool
@@ -22,189 +30,550 @@ type Message struct {
 
 // SubResults describes results of a single SUBSCRIBER / run
 type SubResults struct {
-	ID             string  `json:"id"`
-	Published      int64   `json:"actual_published"`
-	Received       int64   `json:"received"`
-	FwdRatio       float64 `json:"fwd_success_ratio"`
-	FwdLatencyMin  float64 `json:"fwd_time_min"`
-	FwdLatencyMax  float64 `json:"fwd_time_max"`
-	FwdLatencyMean float64 `json:"fwd_time_mean"`
-	FwdLatencyStd  float64 `json:"fwd_time_std"`
-	SubsPerSec     float64 `json:"sub_per_sec"`
-	Duration       float64 `json:"duration"`
-	AvgMsgsPerSec  float64 `json:"avg_msgs_per_sec"`
+	ID                    string             `json:"id"`
+	NodeID                int                `json:"node_id"`
+	Transport             string             `json:"transport"`
+	Published             int64              `json:"actual_published"`
+	Received              int64              `json:"received"`
+	Invalid               int64              `json:"invalid"`
+	Flows                 int                `json:"flows"`
+	Lost                  int64              `json:"lost"`
+	Duplicates            int64              `json:"duplicates"`
+	Reordered             int64              `json:"reordered"`
+	ReorderDistMean       float64            `json:"reorder_distance_mean"`
+	ReorderDistMax        uint64             `json:"reorder_distance_max"`
+	TopicReceived         map[string]int64   `json:"topic_received"`
+	TopicExpected         map[string]int64   `json:"topic_expected"`
+	TopicFwdRatio         map[string]float64 `json:"topic_fwd_success_ratio"`
+	FwdRatio              float64            `json:"fwd_success_ratio"`
+	FwdLatencyMin         float64            `json:"fwd_time_min"`
+	FwdLatencyMax         float64            `json:"fwd_time_max"`
+	FwdLatencyMean        float64            `json:"fwd_time_mean"`
+	FwdLatencyStd         float64            `json:"fwd_time_std"`
+	ConnectTime           float64            `json:"connect_time"`
+	TLSProbe              float64            `json:"tls_probe"`
+	TLSProbeError         string             `json:"tls_probe_error,omitempty"`
+	BelowClockUncertainty int64              `json:"below_clock_uncertainty"`
+	SubsPerSec            float64            `json:"sub_per_sec"`
+	Window                float64            `json:"window"`
+	Duration              float64            `json:"duration"`
+	AvgMsgsPerSec         float64            `json:"avg_msgs_per_sec"`
+	FwdLatency            Percentiles        `json:"fwd_time_percentiles"`
+	FwdHist               *Histogram         `json:"-"`
+	SameNodeHist          *Histogram         `json:"-"`
+	CrossNodeHist         *Histogram         `json:"-"`
 }
 
 // TotalSubResults describes results of all SUBSCRIBER / runs
 type TotalSubResults struct {
-	TotalFwdRatio     float64 `json:"fwd_success_ratio"`
-	TotalReceived     int64   `json:"successes"`
-	TotalPublished    int64   `json:"actual_total_published"`
-	FwdLatencyMin     float64 `json:"fwd_latency_min"`
-	FwdLatencyMax     float64 `json:"fwd_latency_max"`
-	FwdLatencyMeanAvg float64 `json:"fwd_latency_mean_avg"`
-	FwdLatencyMeanStd float64 `json:"fwd_latency_mean_std"`
-	TotalMsgsPerSec   float64 `json:"avg_msgs_per_sec"`
+	TotalFwdRatio              float64            `json:"fwd_success_ratio"`
+	TotalReceived              int64              `json:"successes"`
+	TotalInvalid               int64              `json:"invalid"`
+	TotalFlows                 int                `json:"flows"`
+	TotalLost                  int64              `json:"lost"`
+	TotalDuplicates            int64              `json:"duplicates"`
+	TotalReordered             int64              `json:"reordered"`
+	ReorderDistMean            float64            `json:"reorder_distance_mean"`
+	ReorderDistMax             uint64             `json:"reorder_distance_max"`
+	TopicFwdRatio              map[string]float64 `json:"topic_fwd_success_ratio"`
+	TotalPublished             int64              `json:"actual_total_published"`
+	FwdLatencyMin              float64            `json:"fwd_latency_min"`
+	FwdLatencyMax              float64            `json:"fwd_latency_max"`
+	FwdLatencyMeanAvg          float64            `json:"fwd_latency_mean_avg"`
+	FwdLatencyMeanStd          float64            `json:"fwd_latency_mean_std"`
+	ConnectTimeMean            float64            `json:"connect_time_mean"`
+	TLSProbeMean               float64            `json:"tls_probe_mean"`
+	TLSProbeMax                float64            `json:"tls_probe_max"`
+	TLSProbeFailed             int64              `json:"tls_probe_failed"`
+	ClockUncertainty           float64            `json:"clock_uncertainty"`
+	TotalBelowClockUncertainty int64              `json:"below_clock_uncertainty"`
+	TotalMsgsPerSec            float64            `json:"avg_msgs_per_sec"`
+	FwdLatencyMean             float64            `json:"fwd_latency_mean"`
+	FwdLatencyStd              float64            `json:"fwd_latency_std"`
+	FwdLatency                 Percentiles        `json:"fwd_latency_percentiles"`
 }
 
 // PubResults describes results of a single PUBLISHER / run
 type PubResults struct {
-	ID          string  `json:"id"`
-	Successes   int64   `json:"pub_successes"`
-	Failures    int64   `json:"failures"`
-	RunTime     float64 `json:"run_time"`
-	PubTimeMin  float64 `json:"pub_time_min"`
-	PubTimeMax  float64 `json:"pub_time_max"`
-	PubTimeMean float64 `json:"pub_time_mean"`
-	PubTimeStd  float64 `json:"pub_time_std"`
-	PubsPerSec  float64 `json:"publish_per_sec"`
+	ID             string           `json:"id"`
+	NodeID         int              `json:"node_id"`
+	Transport      string           `json:"transport"`
+	Successes      int64            `json:"pub_successes"`
+	TopicSuccesses map[string]int64 `json:"topic_successes"`
+	Failures       int64            `json:"failures"`
+	RunTime        float64          `json:"run_time"`
+	Window         float64          `json:"window"`
+	PubTimeMin     float64          `json:"pub_time_min"`
+	PubTimeMax     float64          `json:"pub_time_max"`
+	PubTimeMean    float64          `json:"pub_time_mean"`
+	PubTimeStd     float64          `json:"pub_time_std"`
+	PubsPerSec     float64          `json:"publish_per_sec"`
+	IntendedRate   float64          `json:"intended_rate"`
+	SendLagMean    float64          `json:"send_lag_mean"`
+	SendLagMax     float64          `json:"send_lag_max"`
+	ConnectTime    float64          `json:"connect_time"`
+	TLSProbe       float64          `json:"tls_probe"`
+	TLSProbeError  string           `json:"tls_probe_error,omitempty"`
+	PubTime        Percentiles      `json:"pub_time_percentiles"`
+	PubHist        *Histogram       `json:"-"`
+	Echoes         int64            `json:"echoes"`
+	EchoesMissing  int64            `json:"echoes_missing"`
+	RTTMean        float64          `json:"rtt_mean"`
+	RTTMax         float64          `json:"rtt_max"`
+	RTT            Percentiles      `json:"rtt_percentiles"`
+	RTTHist        *Histogram       `json:"-"`
+}
+
+// NodeResults describes results of the clients attached to a single broker node
+type NodeResults struct {
+	NodeID               int         `json:"node_id"`
+	Publishers           int         `json:"publishers"`
+	Subscribers          int         `json:"subscribers"`
+	PubsPerSec           float64     `json:"publish_per_sec"`
+	DeliveriesPerSec     float64     `json:"delivery_per_sec"`
+	SameNodeReceived     uint64      `json:"same_node_received"`
+	CrossNodeReceived    uint64      `json:"cross_node_received"`
+	SameNodeLatencyMean  float64     `json:"same_node_latency_mean"`
+	CrossNodeLatencyMean float64     `json:"cross_node_latency_mean"`
+	SameNodeLatency      Percentiles `json:"same_node_latency_percentiles"`
+	CrossNodeLatency     Percentiles `json:"cross_node_latency_percentiles"`
+}
+
+// TransportResults describes results of the clients using a single transport (tcp, ssl, ws or wss). The publish
+// times are those of its publishers and the forward latencies those of its subscribers.
+type TransportResults struct {
+	Transport      string      `json:"transport"`
+	Publishers     int         `json:"publishers"`
+	Subscribers    int         `json:"subscribers"`
+	PubTimeMean    float64     `json:"pub_time_mean"`
+	PubTime        Percentiles `json:"pub_time_percentiles"`
+	FwdLatencyMean float64     `json:"fwd_latency_mean"`
+	FwdLatency     Percentiles `json:"fwd_latency_percentiles"`
+	RTTMean        float64     `json:"rtt_mean"`
+	RTT            Percentiles `json:"rtt_percentiles"`
 }
 
 // TotalPubResults describes results of all PUBLISHER / runs
 type TotalPubResults struct {
-	PubRatio        float64 `json:"publish_success_ratio"`
-	Successes       int64   `json:"successes"`
-	Failures        int64   `json:"failures"`
-	TotalRunTime    float64 `json:"total_run_time"`
-	AvgRunTime      float64 `json:"avg_run_time"`
-	PubTimeMin      float64 `json:"pub_time_min"`
-	PubTimeMax      float64 `json:"pub_time_max"`
-	PubTimeMeanAvg  float64 `json:"pub_time_mean_avg"`
-	PubTimeMeanStd  float64 `json:"pub_time_mean_std"`
-	TotalMsgsPerSec float64 `json:"total_msgs_per_sec"`
-	AvgMsgsPerSec   float64 `json:"avg_msgs_per_sec"`
+	PubRatio        float64          `json:"publish_success_ratio"`
+	Successes       int64            `json:"successes"`
+	TopicSuccesses  map[string]int64 `json:"topic_successes"`
+	Failures        int64            `json:"failures"`
+	TotalRunTime    float64          `json:"total_run_time"`
+	Window          float64          `json:"window"`
+	AvgRunTime      float64          `json:"avg_run_time"`
+	PubTimeMin      float64          `json:"pub_time_min"`
+	PubTimeMax      float64          `json:"pub_time_max"`
+	PubTimeMeanAvg  float64          `json:"pub_time_mean_avg"`
+	PubTimeMeanStd  float64          `json:"pub_time_mean_std"`
+	TotalMsgsPerSec float64          `json:"total_msgs_per_sec"`
+	AvgMsgsPerSec   float64          `json:"avg_msgs_per_sec"`
+	IntendedRate    float64          `json:"intended_msgs_per_sec"`
+	Seed            uint64           `json:"seed"`
+	PubTimeMean     float64          `json:"pub_time_mean"`
+	PubTimeStd      float64          `json:"pub_time_std"`
+	PubTime         Percentiles      `json:"pub_time_percentiles"`
+	SendLagMeanAvg  float64          `json:"send_lag_mean_avg"`
+	SendLagMax      float64          `json:"send_lag_max"`
+	ConnectTimeMean float64          `json:"connect_time_mean"`
+	TLSProbeMean    float64          `json:"tls_probe_mean"`
+	TLSProbeMax     float64          `json:"tls_probe_max"`
+	TLSProbeFailed  int64            `json:"tls_probe_failed"`
+	Echoes          int64            `json:"echoes"`
+	EchoesMissing   int64            `json:"echoes_missing"`
+	RTTMean         float64          `json:"rtt_mean"`
+	RTTMax          float64          `json:"rtt_max"`
+	RTT             Percentiles      `json:"rtt_percentiles"`
 }
 
 func main() {
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "generate":
+			runGenerate(os.Args[2:])
+			return
+		case "analyze":
+			runAnalyze(os.Args[2:])
+			return
+		case "agent":
+			runAgent(os.Args[2:])
+			return
+		}
+	}
+
 	var (
-		size         = flag.Int("size", 100, "Size of the messages payload (bytes).")
+		size         = flag.Int("size", 100, "Size of the messages payload (bytes), including the 34 bytes benchmark header.")
 		pubqos       = flag.Int("pubqos", 0, "QoS for published messages, default is 0")
 		subqos       = flag.Int("subqos", 0, "QoS for subscribed messages, default is 0")
 		count        = flag.Int("count", 1, "Number of messages to send per pubclient.")
+		duration     = flag.Duration("duration", 0, "Publish for this long, e.g. 10m, instead of -count messages per pubclient.")
+		warmup       = flag.Duration("warmup", 0, "Exclude the messages sent during this time after the start from the statistics.")
+		cooldown     = flag.Duration("cooldown", 0, "Exclude the messages sent during this time before the end of -duration from the statistics.")
 		quiet        = flag.Bool("quiet", false, "Suppress logs while running, default is false")
 		lambda       = flag.Float64("pubrate", 1.0, "Publishing exponential rate (msg/sec).")
 		file         = flag.String("file", "test.json", "Import subscribers, publishers and topic information from file.")
-		nodeport     = flag.Int("nodeport", 30123, "Kubernetes NodepPort for VerneMQ MQTT service.")
-		distribution = flag.String("dist", "poisson", "Select Poisson or Lognormal distribution (default Poisson)")
+		placement    = flag.String("placement", "", "Place clients on the fly instead of reading -file, e.g. \"-algorithm greedy -nodes 2 -gamma 1.2\" (see generate -h).")
+		topology     = flag.String("topology", "files/topology.json", "Broker topology file mapping every node_id to its broker URLs.")
+		nodeport     = flag.Int("nodeport", 30123, "Default broker port for topology entries without one (Kubernetes NodePort for VerneMQ MQTT service).")
+		distribution = flag.String("dist", "poisson", "Inter-arrival distribution: constant, poisson, lognormal, pareto, weibull, mmpp or diurnal.")
+		distParams   = flag.String("distparams", "", "Distribution parameters as key=value pairs separated by commas, e.g. \"on=2,off=8\" for mmpp.")
+		topicPolicy  = flag.String("topicpolicy", "roundrobin", "Topic choice of publishers owning several topics: roundrobin, random, weighted or independent.")
+		ratesFile    = flag.String("rates", "", "JSON file mapping topics to their publication rate (msg/sec), used by the weighted and independent topic policies.")
 		cv           = flag.Int("cv", 4, "Select coefficient of variation for the Lognormal distribution (default 4)")
+		traceFile    = flag.String("trace", "", "Replay the messages of a trace file (CSV or JSON lines) instead of generating them.")
+		speedup      = flag.Float64("speedup", 1.0, "Time-scale factor of the trace replay, 2 replays twice as fast.")
+		seed         = flag.Uint64("seed", 0, "Seed of the publishers' random streams, 0 picks a random one (always reported).")
+		format       = flag.String("format", "text", "Output format of the results: text, json or csv.")
+		unit         = flag.String("unit", "ms", "Unit of the reported latencies: ns, us or ms.")
+		out          = flag.String("out", "", "Write the results to this file instead of stdout.")
+		samplesFile  = flag.String("samples", "", "Write time-series samples of the run to this file, CSV when it ends with .csv, JSON lines otherwise.")
+		interval     = flag.Duration("interval", time.Second, "Sampling interval of -samples and -live.")
+		live         = flag.Bool("live", false, "Print a live line with the last sample on stderr while running.")
+		metricsAddr  = flag.String("metrics", "", "Serve live Prometheus metrics on this address at /metrics, e.g. \":9100\".")
+		topicGroup   = flag.Int("topicgroup", 0, "Label the Prometheus metrics by groups of this many consecutive topics, 0 puts all topics in one group.")
+		drain        = flag.Duration("drain", 5*time.Second, "After an interruption (SIGINT or SIGTERM), wait at most this long for the in-flight messages.")
+		agents       = flag.String("agents", "", "Run the clients on these agents (host:port list separated by commas, see agent -h) instead of in this process.")
+		split        = flag.String("split", "client", "Split of the clients between the agents: client (round robin) or node (all the clients of a broker node on the same agent).")
+		echo         = flag.String("echo", "", "Attach an echo responder to each of these node_ids (separated by commas): the publishers measure the round trip of their messages.")
+		caCert       = flag.String("cacert", "", "PEM bundle of the CAs trusted for ssl:// and wss:// brokers, the system ones by default.")
+		clientCert   = flag.String("cert", "", "PEM client certificate for mutual TLS.")
+		clientKey    = flag.String("key", "", "PEM key of the -cert client certificate.")
+		serverName   = flag.String("servername", "", "Server name verified in the broker certificates, the broker host by default.")
+		insecure     = flag.Bool("insecure", false, "Do not verify the broker certificates.")
+		tlsProbe     = flag.Bool("tlsprobe", false, "Time a TLS handshake of every TLS client with its broker on an extra connection before connecting.")
+		crc          = flag.Bool("crc", false, "Add a CRC-32 of the body to the header of every message, checked by the subscribers.")
 	)
 
 	flag.Parse()
 
-	username := ""
-	password := ""
-	format := "text"
+	switch *format {
+	case "text", "json", "csv":
+	default:
+		log.Fatalf("Unknown output format %q\n", *format)
+	}
+	if u, ok := latencyUnits[*unit]; ok {
+		latencyUnit = u
+	} else {
+		log.Fatalf("Unknown latency unit %q\n", *unit)
+	}
+
+	if *duration < 0 || *warmup < 0 || *cooldown < 0 {
+		log.Fatalf("Error: -duration, -warmup and -cooldown must not be negative\n")
+	}
+	if *cooldown > 0 && *duration == 0 {
+		log.Fatalf("Error: -cooldown requires -duration\n")
+	}
+	if *duration > 0 && *warmup+*cooldown >= *duration {
+		log.Fatalf("Error: -warmup and -cooldown leave no measurement window in -duration\n")
+	}
+	if *traceFile == "" && *size < headerSize {
+		log.Fatalf("Error: -size must be at least %v bytes, the size of the benchmark header\n", headerSize)
+	}
 
 	var user Users
 	var arraySubTopics []map[string]byte
-	nodeIDs := make(map[int]string)
+	var nodeIDs map[int]*BrokerNode
 
-	user, arraySubTopics, nodeIDs = populateFromFile(*file, *nodeport)
-
-	//start subscribe
-	subResCh := make(chan *SubResults)
-	jobDone := make(chan bool)
-	subDone := make(chan bool)
-	subCnt := 0
+	if *placement != "" {
+		fs := flag.NewFlagSet("placement", flag.ExitOnError)
+		p, err := parsePlacementFlags(fs, strings.Fields(*placement))
+		if err != nil {
+			log.Fatalf("Error in -placement: %v\n", err)
+		}
+		placed, err := place(p)
+		if err != nil {
+			log.Fatalf("Error placing clients: %v\n", err)
+		}
+		user, arraySubTopics, nodeIDs = populateFromUsers(placed, *topology, *nodeport)
+	} else {
+		user, arraySubTopics, nodeIDs = populateFromFile(*file, *topology, *nodeport)
+	}
 
-	if !*quiet {
-		log.Printf("Starting to subscribe...\n")
+	distPrefix := ""
+	if strings.ToLower(*distribution) == "lognormal" {
+		distPrefix = "cv=" + strconv.Itoa(*cv) + ","
+	}
+	arrival, err := parseArrivalSpec(*distribution, distPrefix+*distParams)
+	if err == nil {
+		_, err = arrival.New(*lambda, nil)
+	}
+	if err != nil {
+		log.Fatalf("Error in the inter-arrival distribution: %v\n", err)
 	}
 
-	for i := 0; i < len(user.Subscribers); i++ {
-		sub := &SubClient{
-			ID: strconv.FormatFloat(user.Subscribers[i].SubID, 'f', -1, 64),
-			//BrokerURL:  "tcp://localhost:1883",
-			BrokerURL:  nodeIDs[user.Subscribers[i].NodeID],
-			BrokerUser: username,
-			BrokerPass: password,
-			SubTopic:   arraySubTopics[i],
-			SubQoS:     byte(*subqos),
-			Quiet:      *quiet,
-			Count:      *count,
-		}
-		go sub.run(subResCh, subDone, jobDone)
-	}
-
-SUBJOBDONE:
-	for {
-		select {
-		case <-subDone:
-			subCnt++
-			if subCnt == len(user.Subscribers) {
-				if !*quiet {
-					log.Printf("All subscribtion jobs are done.\n")
+	var topicRates []float64
+	if *ratesFile != "" {
+		maxTopic := 0
+		for _, pub := range user.Publishers {
+			for _, t := range pub.TopicList {
+				if t > maxTopic {
+					maxTopic = t
 				}
-				break SUBJOBDONE
 			}
 		}
+		if topicRates, err = loadTopicRates(*ratesFile, maxTopic, *lambda); err != nil {
+			log.Fatalf("Error loading topic rates: %v\n", err)
+		}
 	}
 
-	//time.Sleep(3600 * time.Second)
-	//log.Println("Time is up.")
+	if *seed == 0 {
+		*seed = uint64(time.Now().UnixNano())
+	}
 
-	//start publish
-	if !*quiet {
-		log.Printf("Starting publish...\n")
+	var traces [][]TraceRecord
+	if *traceFile != "" {
+		if *speedup <= 0 {
+			log.Fatalf("Error: -speedup must be positive\n")
+		}
+		records, err := loadTrace(*traceFile)
+		if err != nil {
+			log.Fatalf("Error loading trace: %v\n", err)
+		}
+		if traces, err = assignTrace(records, user.Publishers); err != nil {
+			log.Fatalf("Error loading trace: %v\n", err)
+		}
 	}
-	pubResCh := make(chan *PubResults)
-	timeSeq := make(chan int)
 
-	start := time.Now()
-	for i := 0; i < len(user.Publishers); i++ {
-		c := &PubClient{
-			ID: strconv.FormatFloat(user.Publishers[i].PubID, 'f', -1, 64),
-			//BrokerURL:  "tcp://localhost:1883",
-			BrokerURL:  nodeIDs[user.Publishers[i].NodeID],
-			BrokerUser: username,
-			BrokerPass: password,
-			PubTopic:   user.Publishers[i].TopicList,
-			MsgSize:    *size,
-			MsgCount:   *count,
-			PubQoS:     byte(*pubqos),
-			Quiet:      *quiet,
-			Lambda:     *lambda,
+	interrupt := handleSignals()
+	metrics := NewMetrics()
+	if *metricsAddr != "" {
+		metrics.prom = newPromRegistry(*topicGroup)
+		if err := metrics.prom.listen(*metricsAddr); err != nil {
+			log.Fatalf("Error serving metrics on %v: %v\n", *metricsAddr, err)
+		}
+	}
+	var sampler *Sampler
+	if *samplesFile != "" || *live {
+		var console io.Writer
+		if *live {
+			console = os.Stderr
 		}
-		go c.run(pubResCh, timeSeq, *distribution, *cv)
+		if sampler, err = NewSampler(metrics, *interval, *samplesFile, console); err != nil {
+			log.Fatalf("Error creating the sampler: %v\n", err)
+		}
+		sampler.Start()
 	}
 
-	// collect the publish results
-	pubresults := make([]*PubResults, len(user.Publishers))
+	settings := RunSettings{
+		Quiet:    *quiet,
+		Duration: *duration,
+		Warmup:   *warmup,
+		Cooldown: *cooldown,
+		Drain:    *drain,
+		Unit:     unitName(),
+	}
 
+	// the flags complete the TLS settings of the topology; with agents the files are read by the agents
+	defaultTLS := TLSSettings{
+		CA:                 *caCert,
+		Cert:               *clientCert,
+		Key:                *clientKey,
+		ServerName:         *serverName,
+		InsecureSkipVerify: *insecure,
+		Probe:              *tlsProbe,
+	}
+	nodeTLS := make(map[int]*TLSSettings)
+	for id, node := range nodeIDs {
+		if s := node.tlsSettings(defaultTLS); s != nil {
+			if *agents == "" {
+				if err := s.check(); err != nil {
+					log.Fatalf("Error in the TLS settings of node_id %v: %v\n", id, err)
+				}
+			}
+			nodeTLS[id] = s
+		}
+	}
+
+	pubNodes := make([]int, len(user.Publishers))
+	for i, pub := range user.Publishers {
+		pubNodes[i] = pub.NodeID
+	}
+	subs := make([]*SubClient, len(user.Subscribers))
+	for i := 0; i < len(user.Subscribers); i++ {
+		subs[i] = &SubClient{
+			ID:          strconv.FormatFloat(user.Subscribers[i].SubID, 'f', -1, 64),
+			NodeID:      user.Subscribers[i].NodeID,
+			PubNodes:    pubNodes,
+			BrokerURLs:  nodeIDs[user.Subscribers[i].NodeID].URLs,
+			BrokerUser:  nodeIDs[user.Subscribers[i].NodeID].Username,
+			BrokerPass:  nodeIDs[user.Subscribers[i].NodeID].Password,
+			TLS:         nodeTLS[user.Subscribers[i].NodeID],
+			Headers:     nodeIDs[user.Subscribers[i].NodeID].Headers,
+			Subprotocol: nodeIDs[user.Subscribers[i].NodeID].Subprotocol,
+			SubTopic:    arraySubTopics[i],
+			SubQoS:      byte(*subqos),
+			Quiet:       *quiet,
+			Count:       *count,
+		}
+	}
+	var echoes []*EchoClient
+	if *echo != "" {
+		echoTopics := make(map[string]byte)
+		for _, pub := range user.Publishers {
+			for _, t := range pub.TopicList {
+				echoTopics[strconv.Itoa(t)] = byte(*subqos)
+			}
+		}
+		for _, field := range strings.Split(*echo, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				log.Fatalf("Error in -echo: %v\n", err)
+			}
+			node, ok := nodeIDs[id]
+			if !ok {
+				log.Fatalf("Error in -echo: node_id %v is not defined in the topology\n", id)
+			}
+			echoes = append(echoes, &EchoClient{
+				ID:          strconv.Itoa(len(echoes) + 1),
+				NodeID:      id,
+				BrokerURLs:  node.URLs,
+				BrokerUser:  node.Username,
+				BrokerPass:  node.Password,
+				TLS:         nodeTLS[id],
+				Headers:     node.Headers,
+				Subprotocol: node.Subprotocol,
+				Topics:      echoTopics,
+				PubQoS:      byte(*pubqos),
+				Quiet:       *quiet,
+			})
+		}
+	}
+	pubs := make([]*PubClient, len(user.Publishers))
 	for i := 0; i < len(user.Publishers); i++ {
-		pubresults[i] = <-pubResCh
+		pubs[i] = &PubClient{
+			ID:          strconv.FormatFloat(user.Publishers[i].PubID, 'f', -1, 64),
+			Number:      uint32(i),
+			NodeID:      user.Publishers[i].NodeID,
+			BrokerURLs:  nodeIDs[user.Publishers[i].NodeID].URLs,
+			BrokerUser:  nodeIDs[user.Publishers[i].NodeID].Username,
+			BrokerPass:  nodeIDs[user.Publishers[i].NodeID].Password,
+			TLS:         nodeTLS[user.Publishers[i].NodeID],
+			Headers:     nodeIDs[user.Publishers[i].NodeID].Headers,
+			Subprotocol: nodeIDs[user.Publishers[i].NodeID].Subprotocol,
+			PubTopic:    user.Publishers[i].TopicList,
+			MsgSize:     *size,
+			MsgCount:    *count,
+			PubQoS:      byte(*pubqos),
+			Quiet:       *quiet,
+			Lambda:      *lambda,
+			Arrival:     arrival,
+			TopicPolicy: *topicPolicy,
+			TopicRates:  topicWeights(user.Publishers[i].TopicList, topicRates, *lambda),
+			Replay:      traces != nil,
+			Speedup:     *speedup,
+			Seed:        *seed,
+			CRC:         *crc,
+			Echoes:      len(echoes),
+		}
+		if traces != nil {
+			pubs[i].Trace = traces[i]
+		}
+		if err := pubs[i].prepare(); err != nil {
+			log.Fatalf("Error: %v\n", err)
+		}
 	}
 
-	totalTime := time.Now().Sub(start)
+	var runner Runner = &Run{
+		Settings:    settings,
+		Subscribers: subs,
+		Publishers:  pubs,
+		Echoes:      echoes,
+		Metrics:     metrics,
+		Window:      new(Window),
+		Interrupt:   interrupt,
+	}
+	var coordinator *Coordinator
+	if *agents != "" {
+		var err error
+		coordinator, err = newCoordinator(strings.Split(*agents, ","), *split, settings, subs, pubs, echoes, interrupt)
+		if err != nil {
+			log.Fatalf("Error in -agents: %v\n", err)
+		}
+		runner = coordinator
+	}
+
+	runner.Subscribe()
+
+	start := time.Now()
+	pubresults := runner.Publish()
+	published := time.Now()
+
+	totalTime := published.Sub(start)
 	pubtotals := calculatePublishResults(pubresults, totalTime)
+	measured := new(Window)
+	settings.openWindow(measured, start)
+	pubtotals.Window = measured.clip(start, published).Seconds()
+	pubtotals.Seed = *seed
 
+DRAIN:
 	for i := 0; i < 3; i++ {
-		time.Sleep(1 * time.Second)
+		select {
+		case <-time.After(1 * time.Second):
+		case <-interrupt:
+			break DRAIN
+		}
 		if !*quiet {
 			log.Printf("Benchmark will stop after %v seconds.\n", 3-i)
 		}
 	}
 
-	// notify subscriber that job done
-	for i := 0; i < len(user.Subscribers); i++ {
-		jobDone <- true
-	}
-
-	// collect subscribe results
-	subresults := make([]*SubResults, len(user.Subscribers))
-	for i := 0; i < len(user.Subscribers); i++ {
-		subresults[i] = <-subResCh
+	subresults := runner.Finish()
+	if sampler != nil {
+		sampler.Stop()
 	}
 
 	// collect the sub results
 	subtotals := calculateSubscribeResults(subresults, pubresults)
 
+	report := &Report{
+		Config: &RunConfig{
+			File:         *file,
+			Distribution: arrival.String(),
+			CV:           *cv,
+			Seed:         *seed,
+			Unit:         unitName(),
+			Interrupted:  closed(interrupt),
+			Flags:        flagValues(),
+		},
+		Publishers:  pubresults,
+		PubTotals:   pubtotals,
+		Subscribers: subresults,
+		SubTotals:   subtotals,
+		Nodes:       calculateNodeResults(pubresults, subresults),
+		Transports:  calculateTransportResults(pubresults, subresults),
+	}
+	if coordinator != nil {
+		report.Clocks = coordinator.clockResults()
+		report.Config.FailedAgents = coordinator.failedAgents()
+		if len(report.Config.FailedAgents) > 0 {
+			report.Config.Interrupted = true
+		}
+		subtotals.ClockUncertainty = inUnit(time.Duration(coordinator.uncertainty))
+	}
+	if *traceFile != "" {
+		report.Config.Trace = *traceFile
+		report.Config.Speedup = *speedup
+	}
+
 	// print stats
-	printResults(pubresults, pubtotals, subresults, subtotals, format, *distribution, *cv)
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("Error creating output file: %v\n", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := printResults(w, report, *format); err != nil {
+		log.Printf("Error writing results: %v\n", err)
+	}
 
-	fmt.Printf("All jobs done. Time spent for the benchmark: %vs\n", math.Round(float64(*count) / *lambda))
-	fmt.Println("======================================================")
+	if *format == "text" {
+		fmt.Fprintf(w, "All jobs done. Time spent for the benchmark: %v\n", time.Since(start).Round(time.Millisecond))
+		fmt.Fprintln(w, "======================================================")
+	}
 }
 
 func calculatePublishResults(pubresults []*PubResults, totalTime time.Duration) *TotalPubResults {
@@ -215,31 +584,64 @@ func calculatePublishResults(pubresults []*PubResults, totalTime time.Duration)
 	msgsPerSecs := make([]float64, len(pubresults))
 	runTimes := make([]float64, len(pubresults))
 	bws := make([]float64, len(pubresults))
+	sendLags := make([]float64, len(pubresults))
+	connectTimes := make([]float64, len(pubresults))
+	var probes []float64
 
-	pubtotals.PubTimeMin = pubresults[0].PubTimeMin
+	pubtotals.TopicSuccesses = make(map[string]int64)
+	pubTimes := NewHistogram()
+	rtts := NewHistogram()
 	for i, res := range pubresults {
+		pubTimes.Merge(res.PubHist)
+		if res.RTTHist != nil {
+			rtts.Merge(res.RTTHist)
+		}
 		pubtotals.Successes += res.Successes
+		pubtotals.EchoesMissing += res.EchoesMissing
+		for topic, n := range res.TopicSuccesses {
+			pubtotals.TopicSuccesses[topic] += n
+		}
 		pubtotals.Failures += res.Failures
 		pubtotals.TotalMsgsPerSec += res.PubsPerSec
 
-		if res.PubTimeMin < pubtotals.PubTimeMin {
-			pubtotals.PubTimeMin = res.PubTimeMin
-		}
-
-		if res.PubTimeMax > pubtotals.PubTimeMax {
-			pubtotals.PubTimeMax = res.PubTimeMax
+		if res.SendLagMax > pubtotals.SendLagMax {
+			pubtotals.SendLagMax = res.SendLagMax
 		}
+		pubtotals.IntendedRate += res.IntendedRate
 
 		pubTimeMeans[i] = res.PubTimeMean
+		sendLags[i] = res.SendLagMean
 		msgsPerSecs[i] = res.PubsPerSec
 		runTimes[i] = res.RunTime
 		bws[i] = res.PubsPerSec
+		connectTimes[i] = res.ConnectTime
+		if res.TLSProbe > 0 {
+			probes = append(probes, res.TLSProbe)
+		}
+		if res.TLSProbeError != "" {
+			pubtotals.TLSProbeFailed++
+		}
 	}
 	pubtotals.PubRatio = float64(pubtotals.Successes) / float64(pubtotals.Successes+pubtotals.Failures)
 	pubtotals.AvgMsgsPerSec = stats.StatsMean(msgsPerSecs)
 	pubtotals.AvgRunTime = stats.StatsMean(runTimes)
 	pubtotals.PubTimeMeanAvg = stats.StatsMean(pubTimeMeans)
 	pubtotals.PubTimeMeanStd = stats.StatsSampleStandardDeviation(pubTimeMeans)
+	pubtotals.SendLagMeanAvg = stats.StatsMean(sendLags)
+	pubtotals.PubTimeMin = inUnit(time.Duration(pubTimes.Min))
+	pubtotals.PubTimeMax = inUnit(time.Duration(pubTimes.Max))
+	pubtotals.PubTimeMean = inUnit(pubTimes.Mean())
+	pubtotals.PubTimeStd = inUnit(pubTimes.Std())
+	pubtotals.PubTime = pubTimes.Percentiles()
+	pubtotals.ConnectTimeMean = stats.StatsMean(connectTimes)
+	if len(probes) > 0 {
+		pubtotals.TLSProbeMean = stats.StatsMean(probes)
+		pubtotals.TLSProbeMax = stats.StatsMax(probes)
+	}
+	pubtotals.Echoes = int64(rtts.Count)
+	pubtotals.RTTMean = inUnit(rtts.Mean())
+	pubtotals.RTTMax = inUnit(time.Duration(rtts.Max))
+	pubtotals.RTT = rtts.Percentiles()
 
 	return pubtotals
 }
@@ -248,64 +650,319 @@ func calculateSubscribeResults(subresults []*SubResults, pubresults []*PubResult
 	subtotals := new(TotalSubResults)
 	fwdLatencyMeans := make([]float64, len(subresults))
 	msgPerSec := make([]float64, len(subresults))
+	connectTimes := make([]float64, len(subresults))
+	var probes []float64
+
+	// every subscriber (or session of a subscriber) expects all the messages published on its topics
+	published := make(map[string]int64)
+	for _, pubres := range pubresults {
+		for topic, n := range pubres.TopicSuccesses {
+			published[topic] += n
+		}
+	}
+	topicReceived := make(map[string]int64)
+	topicExpected := make(map[string]int64)
 
-	subtotals.FwdLatencyMin = subresults[0].FwdLatencyMin
+	fwdLatency := NewHistogram()
 	for i, res := range subresults {
 		subtotals.TotalReceived += res.Received
-
-		if res.FwdLatencyMin < subtotals.FwdLatencyMin {
-			subtotals.FwdLatencyMin = res.FwdLatencyMin
-		}
-
-		if res.FwdLatencyMax > subtotals.FwdLatencyMax {
-			subtotals.FwdLatencyMax = res.FwdLatencyMax
+		subtotals.TotalInvalid += res.Invalid
+		subtotals.TotalBelowClockUncertainty += res.BelowClockUncertainty
+		subtotals.TotalFlows += res.Flows
+		subtotals.TotalLost += res.Lost
+		subtotals.TotalDuplicates += res.Duplicates
+		subtotals.TotalReordered += res.Reordered
+		subtotals.ReorderDistMean += res.ReorderDistMean * float64(res.Reordered)
+		if res.ReorderDistMax > subtotals.ReorderDistMax {
+			subtotals.ReorderDistMax = res.ReorderDistMax
 		}
+		fwdLatency.Merge(res.FwdHist)
 
 		fwdLatencyMeans[i] = res.FwdLatencyMean
-		for _, pubres := range pubresults {
-			if pubres.ID == res.ID {
-				subtotals.TotalPublished += pubres.Successes
-				res.Published = pubres.Successes
-				res.FwdRatio = float64(res.Received) / float64(pubres.Successes)
+		connectTimes[i] = res.ConnectTime
+		if res.TLSProbe > 0 {
+			probes = append(probes, res.TLSProbe)
+		}
+		if res.TLSProbeError != "" {
+			subtotals.TLSProbeFailed++
+		}
+		res.Published = 0
+		res.TopicExpected = make(map[string]int64)
+		res.TopicFwdRatio = make(map[string]float64)
+		for topic, received := range res.TopicReceived {
+			expected := published[topic]
+			res.TopicExpected[topic] = expected
+			res.Published += expected
+			if expected > 0 {
+				res.TopicFwdRatio[topic] = float64(received) / float64(expected)
 			}
+			topicReceived[topic] += received
+			topicExpected[topic] += expected
 		}
+		res.FwdRatio = float64(res.Received) / float64(res.Published)
+		subtotals.TotalPublished += res.Published
 		msgPerSec[i] = res.AvgMsgsPerSec
 		subtotals.TotalMsgsPerSec += msgPerSec[i]
 	}
+	if subtotals.TotalReordered > 0 {
+		subtotals.ReorderDistMean /= float64(subtotals.TotalReordered)
+	}
 	subtotals.FwdLatencyMeanAvg = stats.StatsMean(fwdLatencyMeans)
 	subtotals.FwdLatencyMeanStd = stats.StatsSampleStandardDeviation(fwdLatencyMeans)
 	subtotals.TotalFwdRatio = float64(subtotals.TotalReceived) / float64(subtotals.TotalPublished)
+	subtotals.TopicFwdRatio = make(map[string]float64)
+	for topic, expected := range topicExpected {
+		if expected > 0 {
+			subtotals.TopicFwdRatio[topic] = float64(topicReceived[topic]) / float64(expected)
+		}
+	}
+	subtotals.FwdLatencyMin = inUnit(time.Duration(fwdLatency.Min))
+	subtotals.FwdLatencyMax = inUnit(time.Duration(fwdLatency.Max))
+	subtotals.FwdLatencyMean = inUnit(fwdLatency.Mean())
+	subtotals.FwdLatencyStd = inUnit(fwdLatency.Std())
+	subtotals.FwdLatency = fwdLatency.Percentiles()
+	subtotals.ConnectTimeMean = stats.StatsMean(connectTimes)
+	if len(probes) > 0 {
+		subtotals.TLSProbeMean = stats.StatsMean(probes)
+		subtotals.TLSProbeMax = stats.StatsMax(probes)
+	}
 	//subtotals.TotalMsgsPerSec += msgPerSec
 	return subtotals
 }
 
-func printResults(pubresults []*PubResults, pubtotals *TotalPubResults, subresults []*SubResults, subtotals *TotalSubResults, format string, distribution string, cv int) {
-	pubString := fmt.Sprintf("Published using a %v distribution. ", distribution)
-	if distribution == "lognormal" {
-		pubString += fmt.Sprintf("\nIts coefficient of variation is set to: %v", cv)
+// calculateNodeResults groups the results by broker node. The forward latencies of a node are those of
+// its subscribers, split by whether the publisher of the message is attached to the same node or not.
+func calculateNodeResults(pubresults []*PubResults, subresults []*SubResults) []*NodeResults {
+	nodes := make(map[int]*NodeResults)
+	sameNode := make(map[int]*Histogram)
+	crossNode := make(map[int]*Histogram)
+	node := func(id int) *NodeResults {
+		if _, ok := nodes[id]; !ok {
+			nodes[id] = &NodeResults{NodeID: id}
+			sameNode[id] = NewHistogram()
+			crossNode[id] = NewHistogram()
+		}
+		return nodes[id]
+	}
+
+	for _, res := range pubresults {
+		n := node(res.NodeID)
+		n.Publishers++
+		n.PubsPerSec += res.PubsPerSec
+	}
+	for _, res := range subresults {
+		n := node(res.NodeID)
+		n.Subscribers++
+		n.DeliveriesPerSec += res.AvgMsgsPerSec
+		sameNode[res.NodeID].Merge(res.SameNodeHist)
+		crossNode[res.NodeID].Merge(res.CrossNodeHist)
+	}
+
+	ids := make([]int, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	noderesults := make([]*NodeResults, len(ids))
+	for i, id := range ids {
+		n := nodes[id]
+		n.SameNodeReceived = sameNode[id].Count
+		n.CrossNodeReceived = crossNode[id].Count
+		n.SameNodeLatencyMean = inUnit(sameNode[id].Mean())
+		n.CrossNodeLatencyMean = inUnit(crossNode[id].Mean())
+		n.SameNodeLatency = sameNode[id].Percentiles()
+		n.CrossNodeLatency = crossNode[id].Percentiles()
+		noderesults[i] = n
+	}
+	return noderesults
+}
+
+// calculateTransportResults groups the results by transport
+func calculateTransportResults(pubresults []*PubResults, subresults []*SubResults) []*TransportResults {
+	transports := make(map[string]*TransportResults)
+	pubTimes := make(map[string]*Histogram)
+	fwdLatencies := make(map[string]*Histogram)
+	rtts := make(map[string]*Histogram)
+	group := func(name string) *TransportResults {
+		if _, ok := transports[name]; !ok {
+			transports[name] = &TransportResults{Transport: name}
+			pubTimes[name] = NewHistogram()
+			fwdLatencies[name] = NewHistogram()
+			rtts[name] = NewHistogram()
+		}
+		return transports[name]
+	}
+
+	for _, res := range pubresults {
+		group(res.Transport).Publishers++
+		pubTimes[res.Transport].Merge(res.PubHist)
+		if res.RTTHist != nil {
+			rtts[res.Transport].Merge(res.RTTHist)
+		}
+	}
+	for _, res := range subresults {
+		group(res.Transport).Subscribers++
+		fwdLatencies[res.Transport].Merge(res.FwdHist)
+	}
+
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	results := make([]*TransportResults, len(names))
+	for i, name := range names {
+		t := transports[name]
+		t.PubTimeMean = inUnit(pubTimes[name].Mean())
+		t.PubTime = pubTimes[name].Percentiles()
+		t.FwdLatencyMean = inUnit(fwdLatencies[name].Mean())
+		t.FwdLatency = fwdLatencies[name].Percentiles()
+		t.RTTMean = inUnit(rtts[name].Mean())
+		t.RTT = rtts[name].Percentiles()
+		results[i] = t
+	}
+	return results
+}
+
+func printResults(w io.Writer, report *Report, format string) error {
+	pubresults, pubtotals := report.Publishers, report.PubTotals
+	unit := report.Config.Unit
+	subresults, subtotals := report.Subscribers, report.SubTotals
+	pubString := fmt.Sprintf("Published using a %v distribution. ", report.Config.Distribution)
+	if report.Config.Trace != "" {
+		pubString = fmt.Sprintf("Replayed trace %v with speedup %v. ", report.Config.Trace, report.Config.Speedup)
 	}
 	switch format {
+	case "json":
+		return writeJSON(w, report)
+	case "csv":
+		return writeCSV(w, report)
 	case "text":
-		fmt.Printf("\n%v\n", pubString)
-		fmt.Printf("\n")
-		fmt.Printf("================= TOTAL PUBLISHER (%d) =================\n", len(pubresults))
-		fmt.Printf("Total Publish Success Ratio:   %.2f%% (%d/%d)\n", pubtotals.PubRatio*100, pubtotals.Successes, pubtotals.Successes+pubtotals.Failures)
-		fmt.Printf("Average Runtime (sec):         %.2f\n", pubtotals.AvgRunTime)
-		fmt.Printf("Pub time min (ms):             %.2f\n", pubtotals.PubTimeMin)
-		fmt.Printf("Pub time max (ms):             %.2f\n", pubtotals.PubTimeMax)
-		fmt.Printf("Pub time mean mean (ms):       %.2f\n", pubtotals.PubTimeMeanAvg)
-		fmt.Printf("Pub time mean std (ms):        %.2f\n", pubtotals.PubTimeMeanStd)
-		fmt.Printf("Average Bandwidth (msg/sec):   %.2f\n", pubtotals.AvgMsgsPerSec)
-		fmt.Printf("Total Bandwidth (msg/sec):     %.2f\n\n", pubtotals.TotalMsgsPerSec)
-
-		fmt.Printf("================= TOTAL SUBSCRIBER (%d) =================\n", len(subresults))
-		fmt.Printf("Total Forward Success Ratio:      %.2f%% (%d/%d)\n", subtotals.TotalFwdRatio*100, subtotals.TotalReceived, subtotals.TotalPublished)
-		fmt.Printf("Forward latency min (ms):         %.2f\n", subtotals.FwdLatencyMin)
-		fmt.Printf("Forward latency max (ms):         %.2f\n", subtotals.FwdLatencyMax)
-		fmt.Printf("Forward latency mean std (ms):    %.2f\n", subtotals.FwdLatencyMeanStd)
-		fmt.Printf("Total Mean forward latency (ms):  %.2f\n\n", subtotals.FwdLatencyMeanAvg)
-
-		fmt.Printf("Total Receiving rate (msg/sec): %.2f\n", subtotals.TotalMsgsPerSec)
-	}
-	return
+		if report.Config.Interrupted {
+			fmt.Fprintf(w, "\nINTERRUPTED: partial results\n")
+			if len(report.Config.FailedAgents) > 0 {
+				fmt.Fprintf(w, "Failed agents: %v\n", strings.Join(report.Config.FailedAgents, ", "))
+			}
+		}
+		fmt.Fprintf(w, "\n%v\n", pubString)
+		fmt.Fprintf(w, "Random seed: %v\n", pubtotals.Seed)
+		fmt.Fprintf(w, "\n")
+		fmt.Fprintf(w, "================= TOTAL PUBLISHER (%d) =================\n", len(pubresults))
+		fmt.Fprintf(w, "Total Publish Success Ratio:   %.2f%% (%d/%d)\n", pubtotals.PubRatio*100, pubtotals.Successes, pubtotals.Successes+pubtotals.Failures)
+		fmt.Fprintf(w, "Topics published:              %d\n", len(pubtotals.TopicSuccesses))
+		fmt.Fprintf(w, "Average Runtime (sec):         %.2f\n", pubtotals.AvgRunTime)
+		fmt.Fprintf(w, "Measurement window (sec):      %.2f\n", pubtotals.Window)
+		fmt.Fprintf(w, "Pub time min (%v):             %.2f\n", unit, pubtotals.PubTimeMin)
+		fmt.Fprintf(w, "Pub time max (%v):             %.2f\n", unit, pubtotals.PubTimeMax)
+		fmt.Fprintf(w, "Pub time mean (%v):            %.2f\n", unit, pubtotals.PubTimeMean)
+		fmt.Fprintf(w, "Pub time std (%v):             %.2f\n", unit, pubtotals.PubTimeStd)
+		fmt.Fprintf(w, "Pub time mean mean (%v):       %.2f\n", unit, pubtotals.PubTimeMeanAvg)
+		fmt.Fprintf(w, "Pub time mean std (%v):        %.2f\n", unit, pubtotals.PubTimeMeanStd)
+		fmt.Fprintf(w, "Pub time percentiles (%v):     %v\n", unit, formatPercentiles(pubtotals.PubTime))
+		fmt.Fprintf(w, "Send lag mean (%v):            %.2f\n", unit, pubtotals.SendLagMeanAvg)
+		fmt.Fprintf(w, "Send lag max (%v):             %.2f\n", unit, pubtotals.SendLagMax)
+		fmt.Fprintf(w, "Average Bandwidth (msg/sec):   %.2f\n", pubtotals.AvgMsgsPerSec)
+		fmt.Fprintf(w, "Intended Bandwidth (msg/sec):  %.2f\n", pubtotals.IntendedRate)
+		fmt.Fprintf(w, "Total Bandwidth (msg/sec):     %.2f\n", pubtotals.TotalMsgsPerSec)
+		fmt.Fprintf(w, "Connect time mean (%v):        %.2f\n", unit, pubtotals.ConnectTimeMean)
+		if pubtotals.TLSProbeMean > 0 {
+			fmt.Fprintf(w, "TLS probe mean (%v):           %.2f\n", unit, pubtotals.TLSProbeMean)
+			fmt.Fprintf(w, "TLS probe max (%v):            %.2f\n", unit, pubtotals.TLSProbeMax)
+		}
+		if pubtotals.TLSProbeFailed > 0 {
+			fmt.Fprintf(w, "TLS probes failed:             %d\n", pubtotals.TLSProbeFailed)
+		}
+		if pubtotals.Echoes > 0 || pubtotals.EchoesMissing > 0 {
+			fmt.Fprintf(w, "Echoes received:               %d\n", pubtotals.Echoes)
+			fmt.Fprintf(w, "Echoes missing:                %d\n", pubtotals.EchoesMissing)
+			fmt.Fprintf(w, "Round trip mean (%v):          %.2f\n", unit, pubtotals.RTTMean)
+			fmt.Fprintf(w, "Round trip max (%v):           %.2f\n", unit, pubtotals.RTTMax)
+			fmt.Fprintf(w, "Round trip percentiles (%v):   %v\n", unit, formatPercentiles(pubtotals.RTT))
+		}
+		fmt.Fprintf(w, "\n")
+
+		fmt.Fprintf(w, "================= TOTAL SUBSCRIBER (%d) =================\n", len(subresults))
+		fmt.Fprintf(w, "Total Forward Success Ratio:      %.2f%% (%d/%d)\n", subtotals.TotalFwdRatio*100, subtotals.TotalReceived, subtotals.TotalPublished)
+		if topic, ratio, ok := lowestRatio(subtotals.TopicFwdRatio); ok {
+			fmt.Fprintf(w, "Lowest topic forward ratio:       %.2f%% (topic %v)\n", ratio*100, topic)
+		}
+		fmt.Fprintf(w, "Invalid messages:                 %d\n", subtotals.TotalInvalid)
+		fmt.Fprintf(w, "Flows (publisher, topic):         %d\n", subtotals.TotalFlows)
+		fmt.Fprintf(w, "Lost messages:                    %d\n", subtotals.TotalLost)
+		fmt.Fprintf(w, "Duplicate messages:               %d\n", subtotals.TotalDuplicates)
+		fmt.Fprintf(w, "Reordered messages:               %d (distance mean %.2f, max %d)\n", subtotals.TotalReordered, subtotals.ReorderDistMean, subtotals.ReorderDistMax)
+		fmt.Fprintf(w, "Forward latency min (%v):         %.2f\n", unit, subtotals.FwdLatencyMin)
+		fmt.Fprintf(w, "Forward latency max (%v):         %.2f\n", unit, subtotals.FwdLatencyMax)
+		fmt.Fprintf(w, "Forward latency std (%v):         %.2f\n", unit, subtotals.FwdLatencyStd)
+		fmt.Fprintf(w, "Forward latency mean std (%v):    %.2f\n", unit, subtotals.FwdLatencyMeanStd)
+		fmt.Fprintf(w, "Forward latency percentiles (%v): %v\n", unit, formatPercentiles(subtotals.FwdLatency))
+		fmt.Fprintf(w, "Total Mean forward latency (%v):  %.2f\n", unit, subtotals.FwdLatencyMean)
+		fmt.Fprintf(w, "Connect time mean (%v):           %.2f\n", unit, subtotals.ConnectTimeMean)
+		if subtotals.TLSProbeMean > 0 {
+			fmt.Fprintf(w, "TLS probe mean (%v):              %.2f\n", unit, subtotals.TLSProbeMean)
+			fmt.Fprintf(w, "TLS probe max (%v):               %.2f\n", unit, subtotals.TLSProbeMax)
+		}
+		if subtotals.TLSProbeFailed > 0 {
+			fmt.Fprintf(w, "TLS probes failed:                %d\n", subtotals.TLSProbeFailed)
+		}
+		if len(report.Clocks) > 0 {
+			fmt.Fprintf(w, "Clock uncertainty (%v):           %.2f\n", unit, subtotals.ClockUncertainty)
+			fmt.Fprintf(w, "Latencies below the uncertainty:  %d (%.2f%%)\n", subtotals.TotalBelowClockUncertainty,
+				float64(subtotals.TotalBelowClockUncertainty)/float64(subtotals.TotalReceived)*100)
+		}
+		fmt.Fprintf(w, "\n")
+
+		fmt.Fprintf(w, "Total Receiving rate (msg/sec): %.2f\n", subtotals.TotalMsgsPerSec)
+
+		for _, n := range report.Nodes {
+			fmt.Fprintf(w, "\n================= NODE %d (%d pub, %d sub) =================\n", n.NodeID, n.Publishers, n.Subscribers)
+			fmt.Fprintf(w, "Publish rate in (msg/sec):           %.2f\n", n.PubsPerSec)
+			fmt.Fprintf(w, "Delivery rate out (msg/sec):         %.2f\n", n.DeliveriesPerSec)
+			fmt.Fprintf(w, "Same-node deliveries:                %d\n", n.SameNodeReceived)
+			fmt.Fprintf(w, "Same-node latency mean (%v):         %.2f\n", unit, n.SameNodeLatencyMean)
+			fmt.Fprintf(w, "Same-node latency percentiles (%v):  %v\n", unit, formatPercentiles(n.SameNodeLatency))
+			fmt.Fprintf(w, "Cross-node deliveries:               %d\n", n.CrossNodeReceived)
+			fmt.Fprintf(w, "Cross-node latency mean (%v):        %.2f\n", unit, n.CrossNodeLatencyMean)
+			fmt.Fprintf(w, "Cross-node latency percentiles (%v): %v\n", unit, formatPercentiles(n.CrossNodeLatency))
+		}
+
+		// transports are compared when the topology mixes them
+		if len(report.Transports) > 1 {
+			for _, t := range report.Transports {
+				fmt.Fprintf(w, "\n================= TRANSPORT %v (%d pub, %d sub) =================\n", t.Transport, t.Publishers, t.Subscribers)
+				fmt.Fprintf(w, "Pub time mean (%v):               %.2f\n", unit, t.PubTimeMean)
+				fmt.Fprintf(w, "Pub time percentiles (%v):        %v\n", unit, formatPercentiles(t.PubTime))
+				fmt.Fprintf(w, "Forward latency mean (%v):        %.2f\n", unit, t.FwdLatencyMean)
+				fmt.Fprintf(w, "Forward latency percentiles (%v): %v\n", unit, formatPercentiles(t.FwdLatency))
+				if pubtotals.Echoes > 0 {
+					fmt.Fprintf(w, "Round trip mean (%v):             %.2f\n", unit, t.RTTMean)
+					fmt.Fprintf(w, "Round trip percentiles (%v):      %v\n", unit, formatPercentiles(t.RTT))
+				}
+			}
+		}
+
+		for _, c := range report.Clocks {
+			fmt.Fprintf(w, "\n================= CLOCK %v (%d estimates, %d applied) =================\n", c.Agent, c.Estimates, c.Applied)
+			fmt.Fprintf(w, "Offset before (%v):         %.3f\n", unit, c.OffsetBefore)
+			fmt.Fprintf(w, "Offset after (%v):          %.3f (check only, not applied)\n", unit, c.OffsetAfter)
+			fmt.Fprintf(w, "Drift (ppm):                %.3f\n", c.Drift)
+			fmt.Fprintf(w, "Uncertainty (%v):           %.3f\n", unit, c.Uncertainty)
+		}
+	}
+	return nil
+}
+
+func formatPercentiles(p Percentiles) string {
+	return fmt.Sprintf("p50 %.2f, p90 %.2f, p99 %.2f, p99.9 %.2f, p99.99 %.2f", p.P50, p.P90, p.P99, p.P999, p.P9999)
+}
+
+// lowestRatio returns the topic with the lowest forward success ratio
+func lowestRatio(ratios map[string]float64) (string, float64, bool) {
+	lowest, found := "", false
+	for topic, ratio := range ratios {
+		if !found || ratio < ratios[lowest] || (ratio == ratios[lowest] && topic < lowest) {
+			lowest, found = topic, true
+		}
+	}
+	return lowest, ratios[lowest], found
 }
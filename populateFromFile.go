@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"strconv"
 )
 
@@ -24,7 +25,7 @@ type Subscriber struct {
 	TopicList []int   `json:"topic_list"`
 }
 
-func populateFromFile(fileName string, nodeport int) (Users, []map[string]byte, map[int]string) {
+func populateFromFile(fileName string, topologyFile string, nodeport int) (Users, []map[string]byte, map[int]*BrokerNode) {
 
 	file, err := ioutil.ReadFile(fileName)
 	if err != nil {
@@ -37,12 +38,26 @@ func populateFromFile(fileName string, nodeport int) (Users, []map[string]byte,
 		fmt.Println(err)
 	}
 
-	nodeIDs := make(map[int]string)
+	return populateFromUsers(user, topologyFile, nodeport)
+}
+
+// populateFromUsers resolves the broker nodes of the clients and builds their subscriptions
+func populateFromUsers(user Users, topologyFile string, nodeport int) (Users, []map[string]byte, map[int]*BrokerNode) {
+	nodeIDs, err := loadTopology(topologyFile, nodeport)
+	if err != nil {
+		log.Fatalf("Error loading broker topology %v: %v\n", topologyFile, err)
+	}
 
-	nodePort := strconv.Itoa(nodeport)
-	nodeIDs[0] = "tcp://localhost:1883"
-	// insert here the list of broker nodes
-	nodeIDs[1] = "tcp://192.168.3.5:" + nodePort
+	for _, pub := range user.Publishers {
+		if _, ok := nodeIDs[pub.NodeID]; !ok {
+			log.Fatalf("Publisher %v references node_id %v which is not defined in %v\n", pub.PubID, pub.NodeID, topologyFile)
+		}
+	}
+	for _, sub := range user.Subscribers {
+		if _, ok := nodeIDs[sub.NodeID]; !ok {
+			log.Fatalf("Subscriber %v references node_id %v which is not defined in %v\n", sub.SubID, sub.NodeID, topologyFile)
+		}
+	}
 
 	arraySubTopics := make([]map[string]byte, len(user.Subscribers))
 	var str string
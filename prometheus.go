@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// promBuckets are the upper bounds (seconds) of the exported latency histogram buckets
+var promBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// promKey labels a series of the benchmark metrics
+type promKey struct {
+	node  int
+	role  string
+	group string
+}
+
+// promSeries holds the counters and histograms of a label set
+type promSeries struct {
+	published  int64
+	failures   int64
+	received   int64
+	duplicates int64
+	lost       int64
+	connLosses int64
+	pubLatency *Histogram
+	fwdLatency *Histogram
+}
+
+// promRegistry exposes the benchmark metrics in the Prometheus text format, labelled by node_id,
+// role (publisher or subscriber) and topic group
+type promRegistry struct {
+	mu        sync.Mutex
+	groupSize int
+	series    map[promKey]*promSeries
+}
+
+// newPromRegistry returns an empty registry grouping topics by ranges of groupSize topics, or
+// all topics together when groupSize is 0
+func newPromRegistry(groupSize int) *promRegistry {
+	return &promRegistry{groupSize: groupSize, series: make(map[promKey]*promSeries)}
+}
+
+// topicGroup returns the group label of a topic
+func (p *promRegistry) topicGroup(topic string) string {
+	if p.groupSize <= 0 || topic == "" {
+		return "all"
+	}
+	t, err := strconv.Atoi(topic)
+	if err != nil {
+		return "all"
+	}
+	return strconv.Itoa(t / p.groupSize)
+}
+
+// get returns the series of a label set, p.mu must be held
+func (p *promRegistry) get(node int, role string, topic string) *promSeries {
+	key := promKey{node, role, p.topicGroup(topic)}
+	s, ok := p.series[key]
+	if !ok {
+		s = &promSeries{pubLatency: NewHistogram(), fwdLatency: NewHistogram()}
+		p.series[key] = s
+	}
+	return s
+}
+
+// update applies f to the series of a label set
+func (p *promRegistry) update(node int, role string, topic string, f func(s *promSeries)) {
+	p.mu.Lock()
+	f(p.get(node, role, topic))
+	p.mu.Unlock()
+}
+
+// listen serves the metrics on addr at /metrics
+func (p *promRegistry) listen(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p)
+	server := &http.Server{Addr: addr, Handler: mux}
+	errs := make(chan error, 1)
+	go func() { errs <- server.ListenAndServe() }()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func (p *promRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.write(w)
+}
+
+// write writes all the series in the Prometheus text exposition format
+func (p *promRegistry) write(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keys := make([]promKey, 0, len(p.series))
+	for k := range p.series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].node != keys[j].node {
+			return keys[i].node < keys[j].node
+		}
+		if keys[i].role != keys[j].role {
+			return keys[i].role < keys[j].role
+		}
+		return keys[i].group < keys[j].group
+	})
+	labels := func(k promKey) string {
+		return fmt.Sprintf("node_id=\"%d\",role=\"%s\",topic_group=\"%s\"", k.node, k.role, k.group)
+	}
+
+	// every metric is written for the series of its role only, or of all roles when role is empty
+	counters := []struct {
+		name, kind, role, help string
+		value                  func(s *promSeries) int64
+	}{
+		{"mqtt_bench_published_total", "counter", "publisher", "Messages published successfully.", func(s *promSeries) int64 { return s.published }},
+		{"mqtt_bench_publish_failures_total", "counter", "publisher", "Publications that failed.", func(s *promSeries) int64 { return s.failures }},
+		{"mqtt_bench_received_total", "counter", "subscriber", "Benchmark messages received.", func(s *promSeries) int64 { return s.received }},
+		{"mqtt_bench_duplicates_total", "counter", "subscriber", "Duplicate messages received.", func(s *promSeries) int64 { return s.duplicates }},
+		// late arrivals fill the gaps, so the number of lost messages can decrease
+		{"mqtt_bench_lost_messages", "gauge", "subscriber", "Messages missing from the received sequences.", func(s *promSeries) int64 { return s.lost }},
+		{"mqtt_bench_connection_losses_total", "counter", "", "Connections lost by the clients.", func(s *promSeries) int64 { return s.connLosses }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, c.kind)
+		for _, k := range keys {
+			if c.role == "" || c.role == k.role {
+				fmt.Fprintf(w, "%s{%s} %d\n", c.name, labels(k), c.value(p.series[k]))
+			}
+		}
+	}
+
+	histograms := []struct {
+		name, role, help string
+		value            func(s *promSeries) *Histogram
+	}{
+		{"mqtt_bench_publish_latency_seconds", "publisher", "Time from the publication to its acknowledgement.", func(s *promSeries) *Histogram { return s.pubLatency }},
+		{"mqtt_bench_forward_latency_seconds", "subscriber", "Time from the publication to the reception by a subscriber.", func(s *promSeries) *Histogram { return s.fwdLatency }},
+	}
+	for _, h := range histograms {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+		for _, k := range keys {
+			if k.role != h.role {
+				continue
+			}
+			hist := h.value(p.series[k])
+			for i, n := range promCumulative(hist) {
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%v\"} %d\n", h.name, labels(k), promBuckets[i], n)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, labels(k), hist.Count)
+			fmt.Fprintf(w, "%s_sum{%s} %v\n", h.name, labels(k), hist.Sum/float64(time.Second))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, labels(k), hist.Count)
+		}
+	}
+}
+
+// promCumulative returns the cumulative counts of a histogram at the promBuckets bounds
+func promCumulative(h *Histogram) []uint64 {
+	cumulative := make([]uint64, len(promBuckets))
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+		v := time.Duration(histogramValue(i)).Seconds()
+		for j, bound := range promBuckets {
+			if v <= bound {
+				cumulative[j] += n
+			}
+		}
+	}
+	return cumulative
+}
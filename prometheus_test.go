@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromRegistry(t *testing.T) {
+	m := NewMetrics()
+	m.prom = newPromRegistry(10)
+
+	m.send()
+	m.acked(1, "3", false, 300*time.Microsecond)
+	m.send()
+	m.acked(1, "4", false, 3*time.Millisecond)
+	m.send()
+	m.acked(1, "5", true, 0)
+	m.connectionLost(1, "publisher")
+	m.receive(2, "15", 20*time.Millisecond)
+	m.flow(2, "15", 1, 3)
+	m.flow(2, "15", 0, -1)
+
+	server := httptest.NewServer(m.prom)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("content type %q", ct)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(string(body), "\n") {
+		lines[line] = true
+	}
+
+	pub := `node_id="1",role="publisher",topic_group="0"`
+	sub := `node_id="2",role="subscriber",topic_group="1"`
+	for _, want := range []string{
+		"# TYPE mqtt_bench_published_total counter",
+		"mqtt_bench_published_total{" + pub + "} 2",
+		"mqtt_bench_publish_failures_total{" + pub + "} 1",
+		`mqtt_bench_connection_losses_total{node_id="1",role="publisher",topic_group="all"} 1`,
+		"mqtt_bench_received_total{" + sub + "} 1",
+		"mqtt_bench_duplicates_total{" + sub + "} 1",
+		"# TYPE mqtt_bench_lost_messages gauge",
+		"mqtt_bench_lost_messages{" + sub + "} 2",
+		"# TYPE mqtt_bench_publish_latency_seconds histogram",
+		"mqtt_bench_publish_latency_seconds_bucket{" + pub + `,le="0.00025"} 0`,
+		"mqtt_bench_publish_latency_seconds_bucket{" + pub + `,le="0.0005"} 1`,
+		"mqtt_bench_publish_latency_seconds_bucket{" + pub + `,le="0.0025"} 1`,
+		"mqtt_bench_publish_latency_seconds_bucket{" + pub + `,le="0.005"} 2`,
+		"mqtt_bench_publish_latency_seconds_bucket{" + pub + `,le="+Inf"} 2`,
+		"mqtt_bench_publish_latency_seconds_count{" + pub + "} 2",
+		"mqtt_bench_forward_latency_seconds_bucket{" + sub + `,le="0.01"} 0`,
+		"mqtt_bench_forward_latency_seconds_bucket{" + sub + `,le="0.025"} 1`,
+		"mqtt_bench_forward_latency_seconds_count{" + sub + "} 1",
+	} {
+		if !lines[want] {
+			t.Errorf("missing line %q in:\n%s", want, body)
+		}
+	}
+	// metrics of a role are not written for the series of the other role
+	if strings.Contains(string(body), "mqtt_bench_received_total{"+pub) {
+		t.Errorf("subscriber metric written for a publisher series")
+	}
+
+	// the buckets of every histogram are cumulative
+	last := make(map[string]uint64)
+	for _, line := range strings.Split(string(body), "\n") {
+		if !strings.Contains(line, "_bucket{") {
+			continue
+		}
+		i := strings.LastIndex(line, ",le=")
+		n, err := strconv.ParseUint(line[strings.LastIndex(line, " ")+1:], 10, 64)
+		if err != nil {
+			t.Fatalf("bad bucket line %q", line)
+		}
+		if n < last[line[:i]] {
+			t.Errorf("bucket %q below the previous one", line)
+		}
+		last[line[:i]] = n
+	}
+}
+
+func TestPromTopicGroup(t *testing.T) {
+	p := newPromRegistry(10)
+	for topic, group := range map[string]string{"0": "0", "9": "0", "10": "1", "123": "12", "": "all", "x": "all"} {
+		if got := p.topicGroup(topic); got != group {
+			t.Errorf("topicGroup(%q) = %q, want %q", topic, got, group)
+		}
+	}
+	if got := newPromRegistry(0).topicGroup("123"); got != "all" {
+		t.Errorf("topicGroup without groups = %q, want all", got)
+	}
+}
@@ -1,13 +1,11 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"gonum.org/v1/gonum/stat/distuv"
+	"hash/fnv"
 	"log"
-	"math"
-	"os"
 	"strings"
+	"sync"
 
 	"golang.org/x/exp/rand"
 	//"math/rand"
@@ -16,59 +14,138 @@ import (
 )
 
 import (
-	"github.com/GaryBoone/GoStats/stats"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 type PubClient struct {
-	ID         string
-	BrokerURL  string
-	BrokerUser string
-	BrokerPass string
-	PubTopic   []int
-	MsgSize    int
-	MsgCount   int
-	PubQoS     byte
-	Quiet      bool
+	ID          string
+	Number      uint32 // position in the clients file, unique across sessions
+	NodeID      int
+	BrokerURLs  []string
+	BrokerUser  string
+	BrokerPass  string
+	TLS         *TLSSettings      // nil when the node does not use TLS
+	Headers     map[string]string // WebSocket handshake headers
+	Subprotocol string            // WebSocket subprotocol, "mqtt" when empty
+	PubTopic    []int
+	MsgSize     int
+	MsgCount    int
+	PubQoS      byte
+	Quiet       bool
 	//Users      int
-	Lambda float64
+	Lambda      float64
+	Arrival     ArrivalSpec
+	Replay      bool
+	Trace       []TraceRecord
+	Speedup     float64
+	Seed        uint64
+	TopicPolicy string
+	TopicRates  []float64
+	CRC         bool
+	Echoes      int // number of echo responders, each echoing every message back to the publisher
+	// set by the Run executing the publisher
+	Metrics  *Metrics      `json:"-"`
+	Deadline time.Time     `json:"-"` // publishers stop at the deadline instead of after MsgCount messages, if set
+	Window   *Window       `json:"-"`
+	Clock    *Clock        `json:"-"` // converts the send times to the clock shared by the agents
+	Stop     chan bool     `json:"-"` // closed to interrupt the publisher
+	Drain    time.Duration `json:"-"` // bounded wait for the in-flight messages after an interruption
+
+	chooser     *topicChooser    // nil when replaying a trace
+	arrivals    []ArrivalProcess // one per topic with independent arrivals
+	echoes      *echoTracker
+	tlsProbe    time.Duration // TLS handshake probe before connecting
+	tlsProbeErr error         // failure of the probe, which does not prevent connecting
+	connecting  time.Time
+	connectTime time.Duration // time to the first connection
 }
 
-func (c *PubClient) run(res chan *PubResults, ts chan int, distribution string, cv int) {
+func (c *PubClient) run(res chan *PubResults, ts chan int) {
 	newMsgs := make(chan *Message)
 	pubMsgs := make(chan *Message)
 	doneGen := make(chan bool)
+	stopGen := make(chan bool)
 	donePub := make(chan bool)
 	runResults := new(PubResults)
 
+	if c.Echoes > 0 {
+		c.echoes = newEchoTracker(c.Echoes, c.Window)
+	}
+
 	started := time.Now()
 	// start generator
-	go c.genMessages(newMsgs, doneGen)
+	go c.genMessages(newMsgs, doneGen, stopGen)
 	// start publisher
-	go c.pubMessages(newMsgs, pubMsgs, doneGen, donePub, distribution, cv)
+	go c.pubMessages(newMsgs, pubMsgs, doneGen, stopGen, donePub)
 
 	runResults.ID = c.ID
-	times := []float64{}
+	runResults.NodeID = c.NodeID
+	runResults.Transport = transport(c.BrokerURLs)
+	runResults.TopicSuccesses = make(map[string]int64)
+	runResults.IntendedRate = c.Lambda
+	if strings.ToLower(c.TopicPolicy) == "independent" {
+		runResults.IntendedRate = 0
+		for _, rate := range c.TopicRates {
+			runResults.IntendedRate += rate
+		}
+	}
+	if c.Replay {
+		runResults.IntendedRate = 0
+		if n := len(c.Trace); n > 0 && c.Trace[n-1].Time > 0 {
+			runResults.IntendedRate = float64(n) / traceOffset(c.Trace[n-1], c.Speedup).Seconds()
+		}
+	}
+	times := NewHistogram()
+	lags := NewHistogram()
 	for {
 		select {
 		case m := <-pubMsgs:
+			// messages sent during the warm-up or the cool-down are not measured
+			if !c.Window.contains(m.Sent.UnixNano()) {
+				continue
+			}
+			lags.Record(m.Sent.Sub(m.Scheduled))
 			if m.Error {
 				log.Printf("Publisher-%v ERROR publishing message: %v: at %v\n", c.ID, m.Topic, m.Sent.Unix())
 				runResults.Failures++
 			} else {
 				// log.Printf("Message published: %v: sent: %v delivered: %v flight time: %v\n", m.Topic, m.Sent, m.Delivered, m.Delivered.Sub(m.Sent))
 				runResults.Successes++
-				times = append(times, m.Delivered.Sub(m.Sent).Seconds()*1000) // in milliseconds
+				runResults.TopicSuccesses[m.Topic]++
+				times.Record(m.Delivered.Sub(m.Sent))
 			}
 		case <-donePub:
 			// calculate results
-			duration := time.Now().Sub(started)
-			runResults.PubTimeMin = stats.StatsMin(times)
-			runResults.PubTimeMax = stats.StatsMax(times)
-			runResults.PubTimeMean = stats.StatsMean(times)
-			runResults.PubTimeStd = stats.StatsSampleStandardDeviation(times)
+			finished := time.Now()
+			duration := finished.Sub(started)
+			window := c.Window.clip(started, finished)
+			runResults.PubTimeMin = inUnit(time.Duration(times.Min))
+			runResults.PubTimeMax = inUnit(time.Duration(times.Max))
+			runResults.PubTimeMean = inUnit(times.Mean())
+			runResults.PubTimeStd = inUnit(times.Std())
+			runResults.PubTime = times.Percentiles()
+			runResults.PubHist = times
+			runResults.SendLagMean = inUnit(lags.Mean())
+			runResults.SendLagMax = inUnit(time.Duration(lags.Max))
 			runResults.RunTime = duration.Seconds()
-			runResults.PubsPerSec = float64(runResults.Successes) / duration.Seconds()
+			runResults.Window = window.Seconds()
+			if window > 0 {
+				runResults.PubsPerSec = float64(runResults.Successes) / window.Seconds()
+			}
+			runResults.ConnectTime = inUnit(c.connectTime)
+			runResults.TLSProbe = inUnit(c.tlsProbe)
+			if c.tlsProbeErr != nil {
+				runResults.TLSProbeError = c.tlsProbeErr.Error()
+			}
+			if c.echoes != nil {
+				rtt, missing := c.echoes.result()
+				runResults.Echoes = int64(rtt.Count)
+				runResults.EchoesMissing = missing
+				runResults.RTTMean = inUnit(rtt.Mean())
+				runResults.RTTMax = inUnit(time.Duration(rtt.Max))
+				runResults.RTT = rtt.Percentiles()
+				runResults.RTTHist = rtt
+			}
 
 			// report results and exit
 			res <- runResults
@@ -77,103 +154,304 @@ func (c *PubClient) run(res chan *PubResults, ts chan int, distribution string,
 	}
 }
 
-func (c *PubClient) genMessages(ch chan *Message, done chan bool) {
+// genMessages generates MsgCount messages, or messages until stop is closed when the publisher has a deadline
+func (c *PubClient) genMessages(ch chan *Message, done chan bool, stop chan bool) {
+	if c.Replay {
+		c.genTraceMessages(ch, done, stop)
+		return
+	}
 	//var delay float64 = 1
-	///r := rand.New(rand.NewSource(99))
-	//r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	for i := 0; i < c.MsgCount; i++ {
+	payloads := c.rand("payload")
+	chooser := c.chooser
+	for i := 0; i < c.MsgCount || !c.Deadline.IsZero(); i++ {
 
-		ch <- &Message{
-			Topic: strconv.Itoa(c.PubTopic[0]),
-			//Topic: "topic-" + strconv.Itoa(c.PubTopic[0]),
-			//Topic: c.PubTopic,
-			QoS: c.PubQoS,
-			//Payload: make([]byte, c.MsgSize),
+		m := &Message{
+			QoS:  c.PubQoS,
+			Body: make([]byte, bodySize(c.MsgSize)),
+		}
+		payloads.Read(m.Body)
+		// with independent arrivals the topic is chosen by the publisher when the message is due
+		if chooser.policy != "independent" {
+			m.Topic = chooser.topics[chooser.choose()]
+		}
+		select {
+		case ch <- m:
+		case <-stop:
+			return
 		}
 	}
-	done <- true
+	select {
+	case done <- true:
+	case <-stop:
+		return
+	}
 	if !c.Quiet {
 		log.Printf("PUBLISHER %v is done generating messages\n", c.ID)
 	}
 	return
 }
 
-func (c *PubClient) pubMessages(in, out chan *Message, doneGen, donePub chan bool, distribution string, cv int) {
-	onConnected := func(client mqtt.Client) {
-		var delay float64
-
-		ctr := 0
-
-		for {
-			select {
-			case m := <-in:
-				m.Sent = time.Now()
-				convertedTime := strconv.FormatInt(m.Sent.UnixNano(), 10)
-				m.Payload = bytes.Join([][]byte{[]byte(convertedTime), make([]byte, c.MsgSize)}, []byte("#@#"))
-
-				// publish a message
-				token := client.Publish(m.Topic, m.QoS, false, m.Payload)
-				token.Wait()
-
-				if token.Error() != nil {
-					log.Printf("Publisher-%v Error sending message: %v\n", c.ID, token.Error())
-					m.Error = true
-				} else {
-					m.Delivered = time.Now()
-					m.Error = false
-				}
-
-				if strings.ToLower(distribution) == "poisson" {
-					// for poisson distribution
-					r := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
-					delay = math.Max(r.ExpFloat64()/c.Lambda-float64(m.Delivered.Sub(m.Sent).Seconds()), 0)
-				} else if strings.ToLower(distribution) == "lognormal" {
-					// for lognormal distribution
-					Ti := 1 / c.Lambda
-					v := math.Pow(float64(cv)*Ti, 2)
-					mu := math.Log(math.Pow(Ti, 2) / math.Sqrt(v+math.Pow(Ti, 2)))
-					sigma := math.Sqrt(math.Log((v / math.Pow(Ti, 2)) + 1))
-					src := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
-					delay = math.Max(distuv.LogNormal{Mu: mu, Sigma: sigma, Src: src}.Rand()-float64(m.Delivered.Sub(m.Sent).Seconds()), 0)
-				} else {
-					log.Println("Typed wrong distribution as argument. Exiting...")
-					os.Exit(1)
-				}
-
-				// wait for next msg publication
-				time.Sleep(time.Duration(delay*1000000) * time.Microsecond)
+// genTraceMessages generates the messages of the trace records assigned to the publisher
+func (c *PubClient) genTraceMessages(ch chan *Message, done chan bool, stop chan bool) {
+	for _, rec := range c.Trace {
+		// the header takes the place of the first bytes of the recorded payload
+		body := rec.Body[len(rec.Body)-bodySize(len(rec.Body)):]
+		m := &Message{
+			Topic:  rec.Topic,
+			QoS:    rec.QoS,
+			Retain: rec.Retain,
+			Body:   body,
+			Offset: traceOffset(rec, c.Speedup),
+		}
+		select {
+		case ch <- m:
+		case <-stop:
+			return
+		}
+	}
+	select {
+	case done <- true:
+	case <-stop:
+		return
+	}
+	if !c.Quiet {
+		log.Printf("PUBLISHER %v is done replaying %v trace messages\n", c.ID, len(c.Trace))
+	}
+}
 
-				out <- m
-				ctr++
-			case <-doneGen:
-				if !c.Quiet {
-					log.Printf("Publisher-%v connected to broker %v, published on topic: %v\n", c.ID, c.BrokerURL, c.PubTopic)
-				}
-				donePub <- true
-				client.Disconnect(250)
-				return
+func (c *PubClient) pubMessages(in, out chan *Message, doneGen, stopGen, donePub chan bool) {
+	// paho calls the handler on every reconnection: it only restores the connection state, the
+	// schedule below runs once across reconnections
+	onConnected := func(client mqtt.Client) {
+		if c.connectTime == 0 {
+			c.connectTime = time.Since(c.connecting)
+		}
+		c.Metrics.connect()
+		if c.echoes != nil {
+			if token := client.Subscribe(echoTopic(c.Number), c.PubQoS, c.echo); token.Wait() && token.Error() != nil {
+				log.Printf("Publisher-%v had error subscribing to its echoes: %v\n", c.ID, token.Error())
 			}
 		}
 	}
 
 	opts := mqtt.NewClientOptions().
-		AddBroker(c.BrokerURL).
 		SetClientID(fmt.Sprintf("pub-%v", c.ID)).
 		SetCleanSession(true).
 		SetAutoReconnect(true).
 		SetOnConnectHandler(onConnected).
 		SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+			c.Metrics.connectionLost(c.NodeID, "publisher")
 			log.Printf("Publisher-%v lost connection to the broker: %v. Will reconnect...\n", c.ID, reason.Error())
 		})
+	for _, brokerURL := range c.BrokerURLs {
+		opts.AddBroker(brokerURL)
+	}
 	if c.BrokerUser != "" && c.BrokerPass != "" {
 		opts.SetUsername(c.BrokerUser)
 		opts.SetPassword(c.BrokerPass)
 	}
+	setupWebsocket(opts, c.Headers, c.Subprotocol)
+	tlsErr := setupTLS(opts, c.TLS)
+	if tlsErr != nil {
+		log.Printf("Publisher-%v had error setting up TLS: %v\n", c.ID, tlsErr)
+	}
+	if c.tlsProbe, c.tlsProbeErr = c.TLS.probe(c.BrokerURLs); c.tlsProbeErr != nil {
+		log.Printf("Publisher-%v had error probing TLS: %v\n", c.ID, c.tlsProbeErr)
+	}
 	client := mqtt.NewClient(opts)
-	token := client.Connect()
-	token.Wait()
+	c.connecting = time.Now()
+	// without a connection the messages still follow the schedule, and fail
+	if tlsErr == nil {
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
+			log.Printf("Publisher-%v had error connecting to the broker: %v. Error: %v\n", c.ID, c.BrokerURLs, token.Error())
+		}
+	}
 
-	if token.Error() != nil {
-		log.Printf("Publisher-%v had error connecting to the broker: %v. Error: %v\n", c.ID, c.BrokerURL, token.Error())
+	// open-loop schedule: every message has an absolute deadline drawn from the arrival
+	// process, independent of how long the previous publications took
+	var inFlight sync.WaitGroup
+	// every way out of the schedule stops the generator, which must happen once
+	var stopOnce sync.Once
+	stop := func() { stopOnce.Do(func() { close(stopGen) }) }
+	abandoned := make(chan bool) // closed when the publisher stops waiting for its in-flight messages
+	finish := func() {
+		drained := make(chan bool)
+		go func() {
+			inFlight.Wait()
+			close(drained)
+		}()
+		if closed(c.Stop) {
+			select {
+			case <-drained:
+			case <-time.After(c.Drain):
+				log.Printf("Publisher-%v gave up waiting for its in-flight messages\n", c.ID)
+			}
+		} else {
+			<-drained
+		}
+		close(abandoned)
+		if c.echoes != nil {
+			c.echoes.wait(echoWait)
+		}
+		if !c.Quiet {
+			log.Printf("Publisher-%v connected to broker %v, published on topic: %v\n", c.ID, c.BrokerURLs, c.PubTopic)
+		}
+		donePub <- true
+		if client.IsConnected() {
+			c.Metrics.disconnect()
+		}
+		client.Disconnect(250)
+	}
+	started := time.Now()
+	next := started
+	seqs := make(map[string]uint64)
+
+	// with independent arrivals every topic has its own process and next publication time
+	var due []time.Time
+	arrivals := c.arrivals
+	switch {
+	case c.Replay:
+		// the trace gives the schedule
+	case c.chooser.policy == "independent":
+		due = make([]time.Time, len(c.PubTopic))
+		for i := range due {
+			due[i] = next.Add(arrivals[i].Next(0))
+		}
+	default:
+		next = next.Add(arrivals[0].Next(0))
+	}
+
+	for {
+		select {
+		case m := <-in:
+			if c.Replay {
+				m.Scheduled = started.Add(m.Offset)
+			} else if due != nil {
+				i := 0
+				for j := range due {
+					if due[j].Before(due[i]) {
+						i = j
+					}
+				}
+				m.Topic = strconv.Itoa(c.PubTopic[i])
+				m.Scheduled = due[i]
+				due[i] = due[i].Add(arrivals[i].Next(due[i].Sub(started)))
+			} else {
+				m.Scheduled = next
+				next = next.Add(arrivals[0].Next(next.Sub(started)))
+			}
+
+			// stop at the first message due after the deadline
+			if !c.Deadline.IsZero() && m.Scheduled.After(c.Deadline) {
+				stop()
+				finish()
+				return
+			}
+
+			// wait for the msg deadline
+			select {
+			case <-time.After(time.Until(m.Scheduled)):
+			case <-c.Stop:
+				stop()
+				finish()
+				return
+			}
+
+			topic, _ := strconv.ParseUint(m.Topic, 10, 32)
+			m.Seq = seqs[m.Topic]
+			seqs[m.Topic]++
+			// the forward latency runs from the actual send time, the delay to the deadline is the send lag
+			m.Sent = time.Now()
+			header := Header{
+				PubNum:   c.Number,
+				Topic:    uint32(topic),
+				Seq:      m.Seq,
+				SendTime: c.Clock.reference(m.Sent.UnixNano()),
+				CRC:      c.CRC,
+			}
+			m.Payload = header.encode(m.Body)
+			if c.echoes != nil {
+				c.echoes.sent(header, m.Sent)
+			}
+
+			// publish a message without waiting for the previous ones to complete; a failed
+			// publication, e.g. while the client reconnects, is counted as a failure
+			token := client.Publish(m.Topic, m.QoS, m.Retain, m.Payload)
+			inFlight.Add(1)
+			c.Metrics.send()
+			go func(m *Message, token mqtt.Token) {
+				defer inFlight.Done()
+				token.Wait()
+				if token.Error() != nil {
+					log.Printf("Publisher-%v Error sending message: %v\n", c.ID, token.Error())
+					m.Error = true
+					if c.echoes != nil {
+						c.echoes.failed(header)
+					}
+				} else {
+					m.Delivered = time.Now()
+					m.Error = false
+				}
+				c.Metrics.acked(c.NodeID, m.Topic, m.Error, m.Delivered.Sub(m.Sent))
+				select {
+				case out <- m:
+				case <-abandoned:
+				}
+			}(m, token)
+		case <-doneGen:
+			finish()
+			return
+		case <-c.Stop:
+			stop()
+			finish()
+			return
+		}
+	}
+}
+
+// echo receives a message echoed back by a responder
+func (c *PubClient) echo(client mqtt.Client, msg mqtt.Message) {
+	received := time.Now()
+	header, err := decodeHeader(msg.Payload())
+	if err != nil || header.PubNum != c.Number {
+		return
+	}
+	c.echoes.echo(header, received)
+}
+
+// rand returns the random stream of the publisher for the given purpose, derived from the run
+// seed and the publisher ID so that a run with the same seed has the same send schedule.
+func (c *PubClient) rand(purpose string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(c.ID + "/" + purpose))
+	return rand.New(rand.NewSource(c.Seed + h.Sum64()))
+}
+
+// prepare builds the topic chooser and the arrival processes of the publisher, the arrival process
+// of every topic with independent arrivals, so that an invalid configuration is reported before
+// any client connects
+func (c *PubClient) prepare() error {
+	if c.Replay {
+		return nil
+	}
+	chooser, err := newTopicChooser(c.TopicPolicy, c.PubTopic, c.TopicRates, c.rand("topic"))
+	if err != nil {
+		return fmt.Errorf("publisher %v cannot choose topics: %v", c.ID, err)
+	}
+	lambdas := []float64{c.Lambda}
+	if chooser.policy == "independent" {
+		if len(c.TopicRates) != len(c.PubTopic) {
+			return fmt.Errorf("publisher %v has %v topic rates for %v topics", c.ID, len(c.TopicRates), len(c.PubTopic))
+		}
+		lambdas = c.TopicRates
+	}
+	r := c.rand("arrival")
+	arrivals := make([]ArrivalProcess, len(lambdas))
+	for i, lambda := range lambdas {
+		if arrivals[i], err = c.Arrival.New(lambda, r); err != nil {
+			return fmt.Errorf("publisher %v cannot use the %v distribution: %v", c.ID, c.Arrival.Name, err)
+		}
 	}
+	c.chooser, c.arrivals = chooser, arrivals
+	return nil
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RunConfig describes the configuration of a run
+type RunConfig struct {
+	File         string            `json:"file"`
+	Trace        string            `json:"trace,omitempty"`
+	Speedup      float64           `json:"speedup,omitempty"`
+	Distribution string            `json:"distribution"`
+	CV           int               `json:"cv"`
+	Seed         uint64            `json:"seed"`
+	Unit         string            `json:"latency_unit"`
+	Interrupted  bool              `json:"interrupted"`
+	FailedAgents []string          `json:"failed_agents,omitempty"`
+	Flags        map[string]string `json:"flags"`
+}
+
+// Report gathers the configuration and all the results of a run
+type Report struct {
+	Config      *RunConfig          `json:"config"`
+	Publishers  []*PubResults       `json:"publishers"`
+	PubTotals   *TotalPubResults    `json:"publisher_totals"`
+	Subscribers []*SubResults       `json:"subscribers"`
+	SubTotals   *TotalSubResults    `json:"subscriber_totals"`
+	Nodes       []*NodeResults      `json:"nodes"`
+	Transports  []*TransportResults `json:"transports"`
+	Clocks      []*ClockResults     `json:"clocks,omitempty"`
+}
+
+// flagValues returns the value of every command line flag
+func flagValues() map[string]string {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	return flags
+}
+
+// writeJSON writes the report as a single JSON document. JSON has no NaN nor infinity,
+// so undefined statistics (e.g. the latency of a subscriber that received nothing) are written as 0.
+func writeJSON(w io.Writer, report *Report) error {
+	finiteFloats(reflect.ValueOf(report))
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// finiteFloats replaces NaN and infinite floats reachable from v with 0
+func finiteFloats(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			finiteFloats(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			finiteFloats(v.Field(i))
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			finiteFloats(v.Index(i))
+		}
+	case reflect.Float32, reflect.Float64:
+		if f := v.Float(); (math.IsNaN(f) || math.IsInf(f, 0)) && v.CanSet() {
+			v.SetFloat(0)
+		}
+	}
+}
+
+// writeCSV writes the report as CSV sections separated by an empty line: the run
+// configuration, the publishers, the publisher totals, the subscribers, the subscriber totals, the nodes,
+// the transports and, for distributed runs, the clocks of the agents.
+// Every section starts with a header row named after the JSON fields.
+func writeCSV(w io.Writer, report *Report) error {
+	cw := csv.NewWriter(w)
+
+	keys := make([]string, 0, len(report.Config.Flags))
+	for k := range report.Config.Flags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	cw.Write([]string{"record", "key", "value"})
+	cw.Write([]string{"config", "file", report.Config.File})
+	cw.Write([]string{"config", "distribution", report.Config.Distribution})
+	cw.Write([]string{"config", "seed", strconv.FormatUint(report.Config.Seed, 10)})
+	cw.Write([]string{"config", "latency_unit", report.Config.Unit})
+	cw.Write([]string{"config", "interrupted", strconv.FormatBool(report.Config.Interrupted)})
+	if len(report.Config.FailedAgents) > 0 {
+		cw.Write([]string{"config", "failed_agents", strings.Join(report.Config.FailedAgents, " ")})
+	}
+	for _, k := range keys {
+		cw.Write([]string{"flag", k, report.Config.Flags[k]})
+	}
+
+	sections := []struct {
+		record string
+		rows   interface{}
+	}{
+		{"publisher", report.Publishers},
+		{"publisher_total", []*TotalPubResults{report.PubTotals}},
+		{"subscriber", report.Subscribers},
+		{"subscriber_total", []*TotalSubResults{report.SubTotals}},
+		{"node", report.Nodes},
+		{"transport", report.Transports},
+		{"clock", report.Clocks},
+	}
+	for _, section := range sections {
+		if section.record == "clock" && len(report.Clocks) == 0 {
+			continue
+		}
+		cw.Flush()
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+		rows := reflect.ValueOf(section.rows)
+		cw.Write(append([]string{"record"}, csvHeader(rows.Type().Elem().Elem())...))
+		for i := 0; i < rows.Len(); i++ {
+			cw.Write(append([]string{section.record}, csvRow(rows.Index(i).Elem())...))
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvHeader returns the JSON names of the fields of a results struct
+func csvHeader(t reflect.Type) []string {
+	var header []string
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		header = append(header, name)
+	}
+	return header
+}
+
+// csvRow returns the values of the fields of a results struct; maps and slices are JSON encoded
+func csvRow(v reflect.Value) []string {
+	var row []string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.Float32, reflect.Float64:
+			row = append(row, strconv.FormatFloat(field.Float(), 'g', -1, 64))
+		case reflect.Map, reflect.Slice, reflect.Struct, reflect.Ptr:
+			b, err := json.Marshal(field.Interface())
+			if err != nil {
+				b = []byte(err.Error())
+			}
+			row = append(row, string(b))
+		default:
+			row = append(row, fmt.Sprint(field.Interface()))
+		}
+	}
+	return row
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Runner executes the phases of a benchmark: the subscribers connect and subscribe, then the
+// publishers publish, then, after the drain, the subscribers stop and report
+type Runner interface {
+	// Subscribe returns once all the subscribers are subscribed, or on interruption
+	Subscribe()
+	// Publish runs the publishers and returns their results
+	Publish() []*PubResults
+	// Finish stops the subscribers and returns their results
+	Finish() []*SubResults
+}
+
+// RunSettings describes how the clients of a run are driven, shared by all the clients
+type RunSettings struct {
+	Quiet    bool          `json:"quiet"`
+	Duration time.Duration `json:"duration"`
+	Warmup   time.Duration `json:"warmup"`
+	Cooldown time.Duration `json:"cooldown"`
+	Drain    time.Duration `json:"drain"`
+	Unit     string        `json:"unit"`
+}
+
+// Run executes the clients of a benchmark in this process
+type Run struct {
+	Settings    RunSettings
+	Subscribers []*SubClient
+	Publishers  []*PubClient
+	Echoes      []*EchoClient
+	Metrics     *Metrics
+	Window      *Window
+	Clock       *Clock // nil when all the clients share the clock of this process
+	Interrupt   chan bool
+
+	subResCh chan *SubResults
+	jobDone  chan bool
+}
+
+// openWindow sets the measurement window of a run whose publishers start at start and returns
+// the deadline of the publishers, zero for count-based runs
+func (s RunSettings) openWindow(w *Window, start time.Time) time.Time {
+	var deadline, end time.Time
+	if s.Duration > 0 {
+		deadline = start.Add(s.Duration)
+		end = deadline.Add(-s.Cooldown)
+	}
+	w.set(start.Add(s.Warmup), end)
+	return deadline
+}
+
+func (r *Run) Subscribe() {
+	r.subResCh = make(chan *SubResults)
+	r.jobDone = make(chan bool)
+	subDone := make(chan bool)
+
+	if !r.Settings.Quiet {
+		log.Printf("Starting to subscribe...\n")
+	}
+	for _, sub := range r.Subscribers {
+		sub.Metrics = r.Metrics
+		sub.Window = r.Window
+		sub.Clock = r.Clock
+		go sub.run(r.subResCh, subDone, r.jobDone)
+	}
+	// the echo responders are subscribed along with the subscribers
+	for _, echo := range r.Echoes {
+		echo.Metrics = r.Metrics
+		go echo.run(subDone, r.jobDone)
+	}
+
+	subCnt := 0
+SUBJOBDONE:
+	for subCnt < len(r.Subscribers)+len(r.Echoes) {
+		select {
+		case <-subDone:
+			subCnt++
+			if subCnt == len(r.Subscribers)+len(r.Echoes) {
+				if !r.Settings.Quiet {
+					log.Printf("All subscribtion jobs are done.\n")
+				}
+			}
+		case <-r.Interrupt:
+			break SUBJOBDONE
+		}
+	}
+}
+
+func (r *Run) Publish() []*PubResults {
+	if !r.Settings.Quiet {
+		log.Printf("Starting publish...\n")
+	}
+	pubResCh := make(chan *PubResults)
+	timeSeq := make(chan int)
+
+	deadline := r.Settings.openWindow(r.Window, time.Now())
+	pubCnt := 0
+	for _, c := range r.Publishers {
+		if closed(r.Interrupt) {
+			break
+		}
+		c.Metrics = r.Metrics
+		c.Window = r.Window
+		c.Clock = r.Clock
+		c.Deadline = deadline
+		c.Stop = r.Interrupt
+		c.Drain = r.Settings.Drain
+		go c.run(pubResCh, timeSeq)
+		pubCnt++
+	}
+
+	// collect the publish results
+	// after an interruption, the publishers that cannot drain in time are left out
+	pubresults := make([]*PubResults, 0, pubCnt)
+	stopping := r.Interrupt
+	var giveUp <-chan time.Time
+PUBJOBDONE:
+	for len(pubresults) < pubCnt {
+		select {
+		case res := <-pubResCh:
+			pubresults = append(pubresults, res)
+		case <-stopping:
+			stopping = nil
+			giveUp = time.After(r.Settings.Drain + time.Second)
+		case <-giveUp:
+			log.Printf("%v publishers did not stop in time, their results are missing.\n", pubCnt-len(pubresults))
+			break PUBJOBDONE
+		}
+	}
+	return pubresults
+}
+
+func (r *Run) Finish() []*SubResults {
+	// notify subscriber that job done
+	close(r.jobDone)
+
+	// collect subscribe results
+	subresults := make([]*SubResults, 0, len(r.Subscribers))
+	var giveUp <-chan time.Time
+	if closed(r.Interrupt) {
+		giveUp = time.After(r.Settings.Drain)
+	}
+SUBRESULTS:
+	for len(subresults) < len(r.Subscribers) {
+		select {
+		case res := <-r.subResCh:
+			subresults = append(subresults, res)
+		case <-giveUp:
+			log.Printf("%v subscribers did not stop in time, their results are missing.\n", len(r.Subscribers)-len(subresults))
+			break SUBRESULTS
+		}
+	}
+	return subresults
+}
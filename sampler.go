@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics gathers the live counters of all the clients of a run, sampled at regular intervals
+type Metrics struct {
+	published int64
+	errors    int64
+	received  int64
+	inFlight  int64
+	connected int64
+
+	mu      sync.Mutex
+	latency *Histogram
+
+	// prom exports the labelled metrics, when enabled
+	prom *promRegistry
+}
+
+// NewMetrics returns empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{latency: NewHistogram()}
+}
+
+func (m *Metrics) connect()    { atomic.AddInt64(&m.connected, 1) }
+func (m *Metrics) disconnect() { atomic.AddInt64(&m.connected, -1) }
+func (m *Metrics) send()       { atomic.AddInt64(&m.inFlight, 1) }
+
+// connectionLost records the loss of the connection of a client attached to node
+func (m *Metrics) connectionLost(node int, role string) {
+	m.disconnect()
+	if m.prom != nil {
+		m.prom.update(node, role, "", func(s *promSeries) { s.connLosses++ })
+	}
+}
+
+// acked records the completion of a publication sent with send by a publisher attached to node
+func (m *Metrics) acked(node int, topic string, failed bool, latency time.Duration) {
+	atomic.AddInt64(&m.inFlight, -1)
+	if failed {
+		atomic.AddInt64(&m.errors, 1)
+	} else {
+		atomic.AddInt64(&m.published, 1)
+	}
+	if m.prom != nil {
+		m.prom.update(node, "publisher", topic, func(s *promSeries) {
+			if failed {
+				s.failures++
+			} else {
+				s.published++
+				s.pubLatency.Record(latency)
+			}
+		})
+	}
+}
+
+// receive records a message received with the given forward latency by a subscriber attached to node
+func (m *Metrics) receive(node int, topic string, latency time.Duration) {
+	atomic.AddInt64(&m.received, 1)
+	m.mu.Lock()
+	m.latency.Record(latency)
+	m.mu.Unlock()
+	if m.prom != nil {
+		m.prom.update(node, "subscriber", topic, func(s *promSeries) {
+			s.received++
+			s.fwdLatency.Record(latency)
+		})
+	}
+}
+
+// flow records the change of the duplicate and lost messages of a subscriber attached to node
+func (m *Metrics) flow(node int, topic string, duplicates int64, lost int64) {
+	if m.prom != nil && (duplicates != 0 || lost != 0) {
+		m.prom.update(node, "subscriber", topic, func(s *promSeries) {
+			s.duplicates += duplicates
+			s.lost += lost
+		})
+	}
+}
+
+// Sample describes the activity of the clients during one sampling interval
+type Sample struct {
+	Time        float64 `json:"time"`
+	PubRate     float64 `json:"publish_per_sec"`
+	RecvRate    float64 `json:"receive_per_sec"`
+	InFlight    int64   `json:"in_flight"`
+	Errors      int64   `json:"errors"`
+	Connected   int64   `json:"connected"`
+	Received    uint64  `json:"received"`
+	LatencyP50  float64 `json:"fwd_latency_p50"`
+	LatencyP90  float64 `json:"fwd_latency_p90"`
+	LatencyP99  float64 `json:"fwd_latency_p99"`
+	LatencyP999 float64 `json:"fwd_latency_p99_9"`
+	LatencyMax  float64 `json:"fwd_latency_max"`
+}
+
+// Sampler writes a Sample of the metrics every interval, to a JSON lines or CSV file and/or to a live console line
+type Sampler struct {
+	metrics  *Metrics
+	interval time.Duration
+	file     *os.File
+	csv      *csv.Writer
+	json     *json.Encoder
+	live     io.Writer
+	stop     chan bool
+	done     chan bool
+}
+
+// NewSampler creates a sampler writing to fileName, CSV when its name ends with ".csv" and JSON lines otherwise,
+// and to live when not nil
+func NewSampler(metrics *Metrics, interval time.Duration, fileName string, live io.Writer) (*Sampler, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("sampling interval must be positive, got %v", interval)
+	}
+	s := &Sampler{
+		metrics:  metrics,
+		interval: interval,
+		live:     live,
+		stop:     make(chan bool),
+		done:     make(chan bool),
+	}
+	if fileName != "" {
+		f, err := os.Create(fileName)
+		if err != nil {
+			return nil, err
+		}
+		s.file = f
+		if strings.HasSuffix(strings.ToLower(fileName), ".csv") {
+			s.csv = csv.NewWriter(f)
+			s.csv.Write(csvHeader(reflect.TypeOf(Sample{})))
+		} else {
+			s.json = json.NewEncoder(f)
+		}
+	}
+	return s, nil
+}
+
+// Start samples the metrics until Stop is called
+func (s *Sampler) Start() {
+	go func() {
+		started := time.Now()
+		last := started
+		var published, received int64
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			var stopped bool
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				stopped = true
+			}
+			now := time.Now()
+			sample := s.sample(now.Sub(started), now.Sub(last), &published, &received)
+			s.write(sample)
+			last = now
+			if stopped {
+				s.close()
+				s.done <- true
+				return
+			}
+		}
+	}()
+}
+
+// Stop writes the last, possibly shorter, interval and closes the output file
+func (s *Sampler) Stop() {
+	s.stop <- true
+	<-s.done
+}
+
+// sample reads the metrics of the interval ending at elapsed; published and received hold
+// the counters at the end of the previous interval
+func (s *Sampler) sample(elapsed, interval time.Duration, published, received *int64) Sample {
+	m := s.metrics
+	m.mu.Lock()
+	latency := m.latency
+	m.latency = NewHistogram()
+	m.mu.Unlock()
+
+	pub := atomic.LoadInt64(&m.published)
+	recv := atomic.LoadInt64(&m.received)
+	sample := Sample{
+		Time:        elapsed.Seconds(),
+		PubRate:     float64(pub-*published) / interval.Seconds(),
+		RecvRate:    float64(recv-*received) / interval.Seconds(),
+		InFlight:    atomic.LoadInt64(&m.inFlight),
+		Errors:      atomic.SwapInt64(&m.errors, 0),
+		Connected:   atomic.LoadInt64(&m.connected),
+		Received:    latency.Count,
+		LatencyP50:  inUnit(latency.Quantile(0.5)),
+		LatencyP90:  inUnit(latency.Quantile(0.9)),
+		LatencyP99:  inUnit(latency.Quantile(0.99)),
+		LatencyP999: inUnit(latency.Quantile(0.999)),
+		LatencyMax:  inUnit(time.Duration(latency.Max)),
+	}
+	*published, *received = pub, recv
+	return sample
+}
+
+func (s *Sampler) write(sample Sample) {
+	if s.csv != nil {
+		s.csv.Write(csvRow(reflect.ValueOf(sample)))
+		s.csv.Flush()
+	}
+	if s.json != nil {
+		s.json.Encode(sample)
+	}
+	if s.live != nil {
+		fmt.Fprintf(s.live, "\r[%7.1fs] pub %9.1f/s  recv %9.1f/s  in-flight %5d  errors %4d  connected %5d  p50 %.2f%v  p99 %.2f%v ",
+			sample.Time, sample.PubRate, sample.RecvRate, sample.InFlight, sample.Errors, sample.Connected,
+			sample.LatencyP50, unitName(), sample.LatencyP99, unitName())
+	}
+}
+
+func (s *Sampler) close() {
+	if s.live != nil {
+		fmt.Fprintln(s.live)
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals returns a channel closed on the first SIGINT or SIGTERM, after which the run stops
+// and reports partial results; a second signal exits immediately.
+func handleSignals() chan bool {
+	interrupt := make(chan bool)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, stopping the publishers and writing partial results. Send it again to exit now.\n", sig)
+		close(interrupt)
+		sig = <-signals
+		log.Printf("Received %v again, exiting.\n", sig)
+		os.Exit(1)
+	}()
+	return interrupt
+}
+
+// closed reports whether ch is closed
+func closed(ch chan bool) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
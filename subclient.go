@@ -3,79 +3,133 @@ package main
 import (
 	"fmt"
 	"log"
-	"strconv"
 	"time"
 )
 
 import (
-	"github.com/GaryBoone/GoStats/stats"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 type SubClient struct {
-	ID         string
-	BrokerURL  string
-	BrokerUser string
-	BrokerPass string
-	SubTopic   map[string]byte
-	SubQoS     byte
-	Quiet      bool
-	Count      int
-	FirstTime  float64
-	LastTime   float64
+	ID          string
+	NodeID      int
+	PubNodes    []int // node of every publisher, by publisher number
+	BrokerURLs  []string
+	BrokerUser  string
+	BrokerPass  string
+	TLS         *TLSSettings      // nil when the node does not use TLS
+	Headers     map[string]string // WebSocket handshake headers
+	Subprotocol string            // WebSocket subprotocol, "mqtt" when empty
+	SubTopic    map[string]byte
+	SubQoS      byte
+	Quiet       bool
+	Count       int
+	FirstTime   float64
+	LastTime    float64
+	// set by the Run executing the subscriber
+	Metrics *Metrics `json:"-"`
+	Window  *Window  `json:"-"`
+	Clock   *Clock   `json:"-"` // converts the receive times to the clock shared by the agents
 }
 
 func (c *SubClient) run(res chan *SubResults, subDone chan bool, jobDone chan bool) {
 	runResults := new(SubResults)
 	runResults.ID = c.ID
+	runResults.NodeID = c.NodeID
+	runResults.Transport = transport(c.BrokerURLs)
+	runResults.TopicReceived = make(map[string]int64)
+	for topic := range c.SubTopic {
+		runResults.TopicReceived[topic] = 0
+	}
 	c.FirstTime = 0
 	c.LastTime = 0
 
-	var forwardLatency []float64
+	forwardLatency := NewHistogram()
+	sameNode := NewHistogram()
+	crossNode := NewHistogram()
+	flows := newFlowTracker()
 
 	opts := mqtt.NewClientOptions().
-		AddBroker(c.BrokerURL).
 		SetClientID(fmt.Sprintf("sub-%v", c.ID)).
 		SetCleanSession(true).
 		SetAutoReconnect(true).
 		SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
-			recvTime := time.Now().UnixNano()
+			received := time.Now()
+			//started := time.Now()
+			header, latency, err := c.latency(msg.Payload(), received)
+			if err != nil {
+				// not a benchmark message, or a corrupted one
+				runResults.Invalid++
+				return
+			}
+			// sequences are followed across the whole run, the statistics only inside the measurement window
+			duplicates, lost := flows.duplicates, flows.lost()
+			flows.add(header)
+			c.Metrics.flow(c.NodeID, msg.Topic(), flows.duplicates-duplicates, flows.lost()-lost)
+			if !c.Window.contains(c.Clock.local(header.SendTime)) {
+				return
+			}
 			if c.FirstTime == 0 {
-				c.FirstTime = float64(recvTime)
+				c.FirstTime = float64(received.UnixNano())
 			}
-			c.LastTime = float64(recvTime)
-			//started := time.Now()
-			payload := msg.Payload()
-			i := 0
-			for ; i < len(payload)-3; i++ {
-				if payload[i] == '#' && payload[i+1] == '@' && payload[i+2] == '#' {
-					sendTime, _ := strconv.ParseInt(string(payload[:i]), 10, 64)
-					forwardLatency = append(forwardLatency, float64((recvTime-sendTime)/1000000)) // in milliseconds
-					break
+			c.LastTime = float64(received.UnixNano())
+			forwardLatency.Record(latency)
+			// shorter than the error of the clock correction, e.g. negative
+			if u := c.Clock.uncertainty(); u > 0 && latency < u {
+				runResults.BelowClockUncertainty++
+			}
+			c.Metrics.receive(c.NodeID, msg.Topic(), latency)
+			if int(header.PubNum) < len(c.PubNodes) {
+				if c.PubNodes[header.PubNum] == c.NodeID {
+					sameNode.Record(latency)
+				} else {
+					crossNode.Record(latency)
 				}
 			}
 			runResults.Received++
+			runResults.TopicReceived[msg.Topic()]++
 			//rate:= float64(runResults.Received)/((c.LastTime-c.FirstTime)/1e9)
 			// log.Printf("SUBSCRIBER-%v, receiving rate %v \n", c.ID, rate)
 			//runResults.Duration += time.Now().Sub(started).Seconds()
 
 		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			c.Metrics.connect()
+		}).
 		SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+			c.Metrics.connectionLost(c.NodeID, "subscriber")
 			log.Printf("Subscriber-%v lost connection to the broker: %v. Will reconnect...\n", c.ID, reason.Error())
 		})
 
 	//runResults.SubsPerSec = float64(runResults.Received) / duration.Seconds()
 
+	for _, brokerURL := range c.BrokerURLs {
+		opts.AddBroker(brokerURL)
+	}
 	if c.BrokerUser != "" && c.BrokerPass != "" {
 		opts.SetUsername(c.BrokerUser)
 		opts.SetPassword(c.BrokerPass)
 	}
+	setupWebsocket(opts, c.Headers, c.Subprotocol)
+	// the TLS files were checked before the run started
+	if err := setupTLS(opts, c.TLS); err != nil {
+		log.Printf("Subscriber-%v had error setting up TLS: %v\n", c.ID, err)
+		return
+	}
+	probe, err := c.TLS.probe(c.BrokerURLs)
+	if err != nil {
+		log.Printf("Subscriber-%v had error probing TLS: %v\n", c.ID, err)
+		runResults.TLSProbeError = err.Error()
+	}
 	client := mqtt.NewClient(opts)
 
+	connecting := time.Now()
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
 		log.Printf("Subscriber-%v had error connecting to the broker: %v\n", c.ID, token.Error())
 		return
 	}
+	runResults.ConnectTime = inUnit(time.Since(connecting))
+	runResults.TLSProbe = inUnit(probe)
 
 	//if token := client.Subscribe("topic-" + strconv.Itoa(c.SubTopic[0]), c.SubQoS, nil); token.Wait() && token.Error() != nil {
 	if token := client.SubscribeMultiple(c.SubTopic, nil); token.Wait() && token.Error() != nil {
@@ -86,7 +140,7 @@ func (c *SubClient) run(res chan *SubResults, subDone chan bool, jobDone chan bo
 	}
 
 	if !c.Quiet {
-		log.Printf("Subscriber-%v connected to broker: %v\n", c.ID, c.BrokerURL)
+		log.Printf("Subscriber-%v connected to broker: %v\n", c.ID, c.BrokerURLs)
 	}
 
 	subDone <- true
@@ -94,12 +148,27 @@ func (c *SubClient) run(res chan *SubResults, subDone chan bool, jobDone chan bo
 	for {
 		select {
 		case <-jobDone:
+			c.Metrics.disconnect()
 			client.Disconnect(250)
-			runResults.FwdLatencyMin = stats.StatsMin(forwardLatency)
-			runResults.FwdLatencyMax = stats.StatsMax(forwardLatency)
-			runResults.FwdLatencyMean = stats.StatsMean(forwardLatency)
-			runResults.FwdLatencyStd = stats.StatsSampleStandardDeviation(forwardLatency)
-			runResults.AvgMsgsPerSec = float64(runResults.Received) / ((c.LastTime - c.FirstTime) / 1e9)
+			runResults.FwdLatencyMin = inUnit(time.Duration(forwardLatency.Min))
+			runResults.FwdLatencyMax = inUnit(time.Duration(forwardLatency.Max))
+			runResults.FwdLatencyMean = inUnit(forwardLatency.Mean())
+			runResults.FwdLatencyStd = inUnit(forwardLatency.Std())
+			runResults.FwdLatency = forwardLatency.Percentiles()
+			runResults.FwdHist = forwardLatency
+			runResults.SameNodeHist = sameNode
+			runResults.CrossNodeHist = crossNode
+			runResults.Flows = len(flows.flows)
+			runResults.Lost = flows.lost()
+			runResults.Duplicates = flows.duplicates
+			runResults.Reordered = flows.reordered
+			runResults.ReorderDistMean = flows.reorderMean()
+			runResults.ReorderDistMax = flows.reorderMax
+			runResults.Window = (c.LastTime - c.FirstTime) / 1e9
+			// with less than two messages there is no receiving interval to measure a rate over
+			if runResults.Window > 0 {
+				runResults.AvgMsgsPerSec = float64(runResults.Received) / runResults.Window
+			}
 			//log.Printf("Subscriber-%v, receiving rate %v \n", c.ID, runResults.AvgMsgsPerSec)
 			res <- runResults
 			//if !c.Quiet {
@@ -109,3 +178,13 @@ func (c *SubClient) run(res chan *SubResults, subDone chan bool, jobDone chan bo
 		}
 	}
 }
+
+// latency decodes the header of a message received at the local time received and returns its forward
+// latency, measured on the clock shared by the agents
+func (c *SubClient) latency(payload []byte, received time.Time) (Header, time.Duration, error) {
+	header, err := decodeHeader(payload)
+	if err != nil {
+		return header, 0, err
+	}
+	return header, time.Duration(c.Clock.reference(received.UnixNano()) - header.SendTime), nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+)
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// tlsProbeTimeout bounds the TLS handshake probe of a client
+const tlsProbeTimeout = 10 * time.Second
+
+// TLSSettings describes the TLS connections of the clients to the brokers of a node. The files are
+// read by the process running the clients, so with agents they must exist on every agent.
+type TLSSettings struct {
+	CA                 string `json:"ca"`   // PEM bundle of the CAs trusted for the brokers, the system ones when empty
+	Cert               string `json:"cert"` // PEM client certificate, for mutual TLS
+	Key                string `json:"key"`  // PEM key of the client certificate
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	Probe              bool   `json:"probe"` // time a handshake on a connection of its own before connecting
+}
+
+// merge returns the settings completed with defaults where they are not set
+func (s *TLSSettings) merge(defaults TLSSettings) *TLSSettings {
+	merged := defaults
+	if s != nil {
+		if s.CA != "" {
+			merged.CA = s.CA
+		}
+		if s.Cert != "" || s.Key != "" {
+			merged.Cert, merged.Key = s.Cert, s.Key
+		}
+		if s.ServerName != "" {
+			merged.ServerName = s.ServerName
+		}
+		merged.InsecureSkipVerify = merged.InsecureSkipVerify || s.InsecureSkipVerify
+		merged.Probe = merged.Probe || s.Probe
+	}
+	return &merged
+}
+
+// check fails when the files of the settings cannot be loaded
+func (s *TLSSettings) check() error {
+	_, err := s.config()
+	return err
+}
+
+// checkTLS checks the settings of the clients of an agent, nil when a client does not use TLS
+func checkTLS(settings []*TLSSettings) error {
+	for _, s := range settings {
+		if s != nil {
+			if err := s.check(); err != nil {
+				return fmt.Errorf("TLS settings of the agent: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// config builds the TLS configuration of the settings
+func (s *TLSSettings) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         s.ServerName,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+	}
+	if s.CA != "" {
+		pem, err := ioutil.ReadFile(s.CA)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %v", s.CA)
+		}
+	}
+	if s.Cert != "" || s.Key != "" {
+		cert, err := tls.LoadX509KeyPair(s.Cert, s.Key)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// usesTLS reports whether a broker URL connects with TLS
+func usesTLS(brokerURL string) bool {
+	u, err := url.Parse(brokerURL)
+	return err == nil && (u.Scheme == "ssl" || u.Scheme == "wss")
+}
+
+// setupTLS applies the TLS settings of a client to its options
+func setupTLS(opts *mqtt.ClientOptions, s *TLSSettings) error {
+	if s == nil {
+		return nil
+	}
+	config, err := s.config()
+	if err != nil {
+		return err
+	}
+	opts.SetTLSConfig(config)
+	return nil
+}
+
+// probe times a TLS handshake with the first TLS broker of a client on an extra connection of its
+// own, as paho does not expose the handshake of the MQTT connection, if the settings ask for it. It
+// returns 0 when there is no probe. A failed probe is only a failed measurement: the client still
+// connects.
+func (s *TLSSettings) probe(brokerURLs []string) (time.Duration, error) {
+	if s == nil || !s.Probe {
+		return 0, nil
+	}
+	config, err := s.config()
+	if err != nil {
+		return 0, err
+	}
+	for _, brokerURL := range brokerURLs {
+		if usesTLS(brokerURL) {
+			u, _ := url.Parse(brokerURL)
+			return probeTLS(u.Host, config)
+		}
+	}
+	return 0, nil
+}
+
+// probeTLS times a TLS handshake with the broker at addr, excluding the TCP connection
+func probeTLS(addr string, config *tls.Config) (time.Duration, error) {
+	conn, err := net.DialTimeout("tcp", addr, tlsProbeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	config = config.Clone()
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		config.ServerName = host
+	}
+	conn.SetDeadline(time.Now().Add(tlsProbeTimeout))
+	tlsConn := tls.Client(conn, config)
+	started := time.Now()
+	if err := tlsConn.Handshake(); err != nil {
+		return 0, fmt.Errorf("TLS handshake with %v: %v", addr, err)
+	}
+	return time.Since(started), nil
+}
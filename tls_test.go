@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// testCA issues certificates signed by a CA generated for the test
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{}
+	ca.cert, ca.key = ca.issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return ca
+}
+
+// issue signs a certificate from template, self-signed when the CA has no certificate yet
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writePEM writes a certificate and its key in PEM files of dir and returns their paths
+func writePEM(t *testing.T, dir string, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	certFile := filepath.Join(dir, name+".pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// mutualTLSListener listens on the loopback with a server certificate of ca, requiring client
+// certificates of ca, and completes the handshake of every connection. The handshake errors are
+// sent on errs.
+func mutualTLSListener(t *testing.T, ca *testCA, errs chan error) net.Listener {
+	serverCert, serverKey := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "broker"},
+		DNSNames:    []string{"broker.test"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				err := conn.(*tls.Conn).Handshake()
+				select {
+				case errs <- err:
+				default:
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestTLSConfigMutual(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile, _ := writePEM(t, dir, "ca", ca.cert, ca.key)
+	clientCert, clientKey := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	certFile, keyFile := writePEM(t, dir, "client", clientCert, clientKey)
+
+	errs := make(chan error, 1)
+	listener := mutualTLSListener(t, ca, errs)
+	defer listener.Close()
+	addr := listener.Addr().String()
+
+	s := &TLSSettings{CA: caFile, Cert: certFile, Key: keyFile, ServerName: "broker.test"}
+	if err := s.check(); err != nil {
+		t.Fatal(err)
+	}
+	config, err := s.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("mutual TLS: %v", err)
+	}
+	conn.Close()
+	if err := <-errs; err != nil {
+		t.Errorf("server handshake: %v", err)
+	}
+
+	// the probe verifies the broker as the client does, by IP without a server name
+	s.ServerName = ""
+	config, _ = s.config()
+	if d, err := probeTLS(addr, config); err != nil || d <= 0 {
+		t.Errorf("probe: %v, %v", d, err)
+	}
+	<-errs
+
+	// without a client certificate the broker refuses the handshake
+	anonymous, err := (&TLSSettings{CA: caFile}).config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := tls.Dial("tcp", addr, anonymous); err == nil {
+		// with TLS 1.3 the client may only see the refusal on its first read
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err := <-errs; err == nil {
+		t.Error("handshake without a client certificate accepted")
+	}
+
+	// a broker certificate of another CA is not trusted
+	otherFile, _ := writePEM(t, dir, "other", newTestCA(t).cert, ca.key)
+	untrusted, _ := (&TLSSettings{CA: otherFile, Cert: certFile, Key: keyFile}).config()
+	if _, err := probeTLS(addr, untrusted); err == nil {
+		t.Error("probe trusted a broker of another CA")
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(empty, nil, 0600)
+	for name, s := range map[string]*TLSSettings{
+		"missing CA":     {CA: filepath.Join(dir, "missing.pem")},
+		"empty CA":       {CA: empty},
+		"missing key":    {Cert: empty},
+		"bad key pair":   {Cert: empty, Key: empty},
+		"missing client": {Cert: filepath.Join(dir, "missing.pem"), Key: filepath.Join(dir, "missing.key")},
+	} {
+		if err := s.check(); err == nil {
+			t.Errorf("%v: no error", name)
+		}
+	}
+}
+
+func TestTLSSettingsMerge(t *testing.T) {
+	defaults := TLSSettings{CA: "ca.pem", Cert: "c.pem", Key: "c.key", ServerName: "default"}
+	merged := (&TLSSettings{Cert: "node.pem", Key: "node.key", InsecureSkipVerify: true, Probe: true}).merge(defaults)
+	want := TLSSettings{CA: "ca.pem", Cert: "node.pem", Key: "node.key", ServerName: "default", InsecureSkipVerify: true, Probe: true}
+	if *merged != want {
+		t.Errorf("merged %+v, want %+v", *merged, want)
+	}
+	if merged := (*TLSSettings)(nil).merge(defaults); *merged != defaults {
+		t.Errorf("merged nil %+v, want %+v", *merged, defaults)
+	}
+}
+
+func TestTLSProbe(t *testing.T) {
+	// nothing listens on the broker: only a probe would connect to it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	urls := []string{"tcp://" + addr, "ssl://" + addr}
+
+	if err := setupTLS(mqtt.NewClientOptions(), &TLSSettings{Probe: true}); err != nil {
+		t.Errorf("setup with probe: %v", err)
+	}
+	if d, err := (&TLSSettings{}).probe(urls); d != 0 || err != nil {
+		t.Errorf("without probe: %v, %v", d, err)
+	}
+	if _, err := (&TLSSettings{Probe: true}).probe(urls); err == nil {
+		t.Error("probe of a closed port: no error")
+	}
+	if d, err := (&TLSSettings{Probe: true}).probe(urls[:1]); d != 0 || err != nil {
+		t.Errorf("probe without TLS broker: %v, %v", d, err)
+	}
+	if d, err := (*TLSSettings)(nil).probe(urls); d != 0 || err != nil {
+		t.Errorf("without TLS: %v, %v", d, err)
+	}
+	if err := setupTLS(mqtt.NewClientOptions(), &TLSSettings{CA: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("setup with a missing CA: no error")
+	}
+	if err := checkTLS([]*TLSSettings{nil, {}, {CA: filepath.Join(t.TempDir(), "missing.pem")}}); err == nil {
+		t.Error("check of a missing CA: no error")
+	}
+}
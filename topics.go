@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/rand"
+)
+
+// topicChooser selects the topic of the next message of a publisher owning several topics
+type topicChooser struct {
+	policy string
+	topics []string
+	cdf    []float64
+	next   int
+	r      *rand.Rand
+}
+
+// newTopicChooser builds a chooser for the given policy (roundrobin, random or weighted).
+// weights are used by the weighted policy only and are indexed like topics.
+func newTopicChooser(policy string, topics []int, weights []float64, r *rand.Rand) (*topicChooser, error) {
+	tc := &topicChooser{policy: strings.ToLower(policy), r: r}
+	for _, t := range topics {
+		tc.topics = append(tc.topics, strconv.Itoa(t))
+	}
+	if len(tc.topics) == 0 {
+		return nil, fmt.Errorf("no topics to publish on")
+	}
+
+	switch tc.policy {
+	case "roundrobin", "random", "independent":
+	case "weighted":
+		total := 0.0
+		for _, w := range weights {
+			total += w
+			tc.cdf = append(tc.cdf, total)
+		}
+		if len(tc.cdf) != len(tc.topics) || total <= 0 {
+			return nil, fmt.Errorf("weighted topic policy needs a positive rate for every topic")
+		}
+		for i := range tc.cdf {
+			tc.cdf[i] /= total
+		}
+	default:
+		return nil, fmt.Errorf("unknown topic policy %q", policy)
+	}
+	return tc, nil
+}
+
+// choose returns the index of the topic of the next message
+func (tc *topicChooser) choose() int {
+	switch tc.policy {
+	case "random":
+		return tc.r.Intn(len(tc.topics))
+	case "weighted":
+		return sort.SearchFloat64s(tc.cdf, tc.r.Float64())
+	default:
+		i := tc.next
+		tc.next = (tc.next + 1) % len(tc.topics)
+		return i
+	}
+}
+
+// topicWeights returns the rate of every topic of a publisher, using defaultRate
+// for the topics missing from rates.
+func topicWeights(topics []int, rates []float64, defaultRate float64) []float64 {
+	weights := make([]float64, len(topics))
+	for i, t := range topics {
+		weights[i] = defaultRate
+		if t < len(rates) {
+			weights[i] = rates[t]
+		}
+	}
+	return weights
+}
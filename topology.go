@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Topology describes the broker nodes of the cluster under test
+type Topology struct {
+	Nodes []BrokerNode `json:"nodes"`
+}
+
+// BrokerNode describes a single broker node and how clients reach it
+type BrokerNode struct {
+	NodeID      int               `json:"node_id"`
+	Brokers     []string          `json:"brokers"`
+	Scheme      string            `json:"scheme"`
+	Port        int               `json:"port"`
+	Username    string            `json:"username"`
+	Password    string            `json:"password"`
+	Path        string            `json:"path"`        // WebSocket path of ws:// and wss:// entries without one
+	Headers     map[string]string `json:"headers"`     // HTTP headers of the WebSocket opening handshake
+	Subprotocol string            `json:"subprotocol"` // WebSocket subprotocol, "mqtt" when empty
+	TLS         *TLSSettings      `json:"tls"`
+	URLs        []string          `json:"-"`
+}
+
+// loadTopology reads the broker topology file and resolves every broker entry to a full URL.
+// Entries without a port use the node port override, or defaultPort when none is set.
+func loadTopology(fileName string, defaultPort int) (map[int]*BrokerNode, error) {
+	file, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("reading topology file: %v", err)
+	}
+
+	var topology Topology
+	if err := json.Unmarshal(file, &topology); err != nil {
+		return nil, fmt.Errorf("parsing topology file: %v", err)
+	}
+
+	nodes := make(map[int]*BrokerNode)
+	for i := range topology.Nodes {
+		node := &topology.Nodes[i]
+		if _, ok := nodes[node.NodeID]; ok {
+			return nil, fmt.Errorf("node_id %v is defined more than once", node.NodeID)
+		}
+		if len(node.Brokers) == 0 {
+			return nil, fmt.Errorf("node_id %v has no brokers", node.NodeID)
+		}
+		port := defaultPort
+		if node.Port != 0 {
+			port = node.Port
+		}
+		for _, broker := range node.Brokers {
+			brokerURL, err := resolveBrokerURL(broker, node.Scheme, port, node.Port != 0, node.Path)
+			if err != nil {
+				return nil, fmt.Errorf("node_id %v: %v", node.NodeID, err)
+			}
+			node.URLs = append(node.URLs, brokerURL)
+		}
+		nodes[node.NodeID] = node
+	}
+
+	return nodes, nil
+}
+
+// resolveBrokerURL turns a broker entry ("host", "host:port" or "scheme://host:port") into a URL
+// usable by paho, applying the node scheme, port and WebSocket path overrides.
+func resolveBrokerURL(broker string, scheme string, port int, forcePort bool, path string) (string, error) {
+	if !strings.Contains(broker, "://") {
+		if scheme == "" {
+			scheme = "tcp"
+		}
+		broker = scheme + "://" + broker
+	}
+
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", fmt.Errorf("invalid broker %q: %v", broker, err)
+	}
+	if scheme != "" && u.Scheme != scheme {
+		u.Scheme = scheme
+	}
+	switch u.Scheme {
+	case "tcp", "ssl", "ws", "wss":
+	default:
+		return "", fmt.Errorf("unsupported scheme %q for broker %q", u.Scheme, broker)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("missing host for broker %q", broker)
+	}
+	if u.Port() == "" || forcePort {
+		u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+	}
+	if (u.Scheme == "ws" || u.Scheme == "wss") && (u.Path == "" || u.Path == "/") && path != "" {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		u.Path = path
+	}
+
+	return u.String(), nil
+}
+
+// tlsSettings returns the TLS settings of the clients of the node, completed with defaults, or nil
+// when none of its brokers uses TLS
+func (n *BrokerNode) tlsSettings(defaults TLSSettings) *TLSSettings {
+	for _, brokerURL := range n.URLs {
+		if usesTLS(brokerURL) {
+			return n.TLS.merge(defaults)
+		}
+	}
+	return nil
+}
+
+// transport returns the transport of a client, the scheme of its first broker
+func transport(brokerURLs []string) string {
+	if len(brokerURLs) == 0 {
+		return ""
+	}
+	u, err := url.Parse(brokerURLs[0])
+	if err != nil {
+		return ""
+	}
+	return u.Scheme
+}
+
+// setupWebsocket applies the WebSocket handshake headers and subprotocol of a node to the options
+// of a client; paho only uses them for ws:// and wss:// brokers
+func setupWebsocket(opts *mqtt.ClientOptions, headers map[string]string, subprotocol string) {
+	if len(headers) > 0 {
+		opts.SetHTTPHeaders(httpHeaders(headers))
+	}
+	if subprotocol != "" {
+		opts.SetWebsocketProtocol(subprotocol)
+	}
+}
+
+// httpHeaders converts the WebSocket headers of a node for paho
+func httpHeaders(headers map[string]string) http.Header {
+	h := make(http.Header)
+	for k, v := range headers {
+		h.Set(k, v)
+	}
+	return h
+}
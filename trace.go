@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TraceRecord describes a single message of a recorded trace
+type TraceRecord struct {
+	Time    float64 `json:"time"`
+	Topic   string  `json:"topic"`
+	Size    int     `json:"size"`
+	Payload string  `json:"payload"`
+	QoS     byte    `json:"qos"`
+	Retain  bool    `json:"retain"`
+	Body    []byte  `json:"-"`
+}
+
+// loadTrace reads a trace file, either CSV (time,topic,size_or_payload,qos,retain) when its
+// name ends with ".csv" or JSON lines otherwise. Times are in seconds relative to the start
+// of the trace; payloads are base64 encoded and take precedence over sizes.
+func loadTrace(fileName string) ([]TraceRecord, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("reading trace file: %v", err)
+	}
+	defer f.Close()
+
+	var records []TraceRecord
+	if strings.HasSuffix(strings.ToLower(fileName), ".csv") {
+		records, err = readCSVTrace(f)
+	} else {
+		records, err = readJSONTrace(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = decodeTrace(records); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time < records[j].Time })
+	return records, nil
+}
+
+// decodeTrace sets the body of the records from their payload or size and checks their QoS
+func decodeTrace(records []TraceRecord) error {
+	var err error
+	for i := range records {
+		rec := &records[i]
+		if rec.Payload != "" {
+			if rec.Body, err = base64.StdEncoding.DecodeString(rec.Payload); err != nil {
+				return fmt.Errorf("trace record %v: invalid payload: %v", i+1, err)
+			}
+		} else {
+			rec.Body = make([]byte, rec.Size)
+		}
+		if rec.QoS > 2 {
+			return fmt.Errorf("trace record %v: invalid qos %v", i+1, rec.QoS)
+		}
+	}
+	return nil
+}
+
+func readJSONTrace(r io.Reader) ([]TraceRecord, error) {
+	var records []TraceRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var rec TraceRecord
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			return nil, fmt.Errorf("trace line %v: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+func readCSVTrace(r io.Reader) ([]TraceRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("parsing trace: %v", err)
+	}
+
+	var records []TraceRecord
+	for i, row := range rows {
+		// skip the header line, if any
+		if i == 0 && len(row) > 0 && strings.EqualFold(strings.TrimSpace(row[0]), "time") {
+			continue
+		}
+		if len(row) < 3 {
+			return nil, fmt.Errorf("trace line %v: expected at least time, topic and size or payload", i+1)
+		}
+		var rec TraceRecord
+		if rec.Time, err = strconv.ParseFloat(strings.TrimSpace(row[0]), 64); err != nil {
+			return nil, fmt.Errorf("trace line %v: invalid time: %v", i+1, err)
+		}
+		rec.Topic = strings.TrimSpace(row[1])
+		field := strings.TrimSpace(row[2])
+		if size, err := strconv.Atoi(field); err == nil {
+			rec.Size = size
+		} else {
+			rec.Payload = field
+		}
+		if len(row) > 3 && strings.TrimSpace(row[3]) != "" {
+			qos, err := strconv.Atoi(strings.TrimSpace(row[3]))
+			if err != nil {
+				return nil, fmt.Errorf("trace line %v: invalid qos: %v", i+1, err)
+			}
+			rec.QoS = byte(qos)
+		}
+		if len(row) > 4 && strings.TrimSpace(row[4]) != "" {
+			if rec.Retain, err = strconv.ParseBool(strings.TrimSpace(row[4])); err != nil {
+				return nil, fmt.Errorf("trace line %v: invalid retain: %v", i+1, err)
+			}
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// assignTrace maps the trace topics onto the topics of the publishers and returns the records
+// replayed by every publisher. A trace topic equal to a publisher topic is kept; the other
+// trace topics are assigned in order of first appearance to the publisher topics, round robin.
+func assignTrace(records []TraceRecord, publishers []Publisher) ([][]TraceRecord, error) {
+	owner := make(map[string]int)
+	var topics []string
+	for i, pub := range publishers {
+		for _, t := range pub.TopicList {
+			topic := strconv.Itoa(t)
+			if _, ok := owner[topic]; !ok {
+				owner[topic] = i
+				topics = append(topics, topic)
+			}
+		}
+	}
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("no publisher topics to replay the trace on")
+	}
+
+	mapped := make(map[string]string)
+	next := 0
+	assigned := make([][]TraceRecord, len(publishers))
+	for _, rec := range records {
+		topic, ok := mapped[rec.Topic]
+		if !ok {
+			if _, own := owner[rec.Topic]; own {
+				topic = rec.Topic
+			} else {
+				topic = topics[next%len(topics)]
+				next++
+			}
+			mapped[rec.Topic] = topic
+		}
+		rec.Topic = topic
+		i := owner[topic]
+		assigned[i] = append(assigned[i], rec)
+	}
+	return assigned, nil
+}
+
+// traceOffset returns when a record is due after the start of the replay
+func traceOffset(rec TraceRecord, speedup float64) time.Duration {
+	return time.Duration(rec.Time / speedup * float64(time.Second))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Window is the measurement window of a run: only the messages sent inside it are part of the
+// statistics, so that the warm-up and cool-down of the clients and brokers are excluded.
+// It is set once the publishers start, while the subscribers are already receiving.
+type Window struct {
+	from int64 // Unix nanoseconds
+	to   int64 // Unix nanoseconds, 0 when the window is open-ended
+}
+
+// set opens the window at from and closes it at to, or never when to is zero
+func (w *Window) set(from, to time.Time) {
+	atomic.StoreInt64(&w.from, from.UnixNano())
+	if to.IsZero() {
+		atomic.StoreInt64(&w.to, 0)
+	} else {
+		atomic.StoreInt64(&w.to, to.UnixNano())
+	}
+}
+
+// contains reports whether a message sent at t (Unix nanoseconds) is measured
+func (w *Window) contains(t int64) bool {
+	to := atomic.LoadInt64(&w.to)
+	return t >= atomic.LoadInt64(&w.from) && (to == 0 || t <= to)
+}
+
+// clip returns the length of the part of [from, to] inside the window
+func (w *Window) clip(from, to time.Time) time.Duration {
+	start, end := from.UnixNano(), to.UnixNano()
+	if f := atomic.LoadInt64(&w.from); f > start {
+		start = f
+	}
+	if t := atomic.LoadInt64(&w.to); t != 0 && t < end {
+		end = t
+	}
+	if end < start {
+		return 0
+	}
+	return time.Duration(end - start)
+}